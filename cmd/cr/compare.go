@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"gcp/lib/ext"
+
+	c "github.com/logrusorgru/aurora/v4"
+)
+
+// Comparison is a setting of two services side by side.
+type Comparison struct {
+	Key  string `json:"key"`
+	A    string `json:"a,omitempty"`
+	B    string `json:"b,omitempty"`
+	Same bool   `json:"same"`
+}
+
+// Target is a service named on the command line as
+// [PROJECT/]SERVICE[@REGION]. The project and region default to the
+// PROJECTS and REGIONS overrides of the service.
+type Target struct {
+	Service string
+	Project string
+	Region  string
+}
+
+func parseTarget(arg string) Target {
+	t := Target{Service: arg}
+	if project, service, ok := strings.Cut(t.Service, "/"); ok {
+		t.Project, t.Service = project, service
+	}
+	if service, region, ok := strings.Cut(t.Service, "@"); ok {
+		t.Service, t.Region = service, region
+	}
+	if t.Service == "" {
+		ext.Die("invalid service %q, expected [PROJECT/]SERVICE[@REGION]", arg)
+	}
+	if t.Project == "" {
+		t.Project = ext.ProjectFor(t.Service)
+	}
+	if t.Region == "" {
+		t.Region = ext.RegionsFor(t.Service)[0]
+	}
+	return t
+}
+
+func (t Target) String() string {
+	return t.Project + "/" + t.Service + "@" + t.Region
+}
+
+// compare lines up the settings of a and b, sorted by key.
+func compare(a, b map[string]string) []Comparison {
+	keys := slices.Collect(maps.Keys(a))
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+
+	list := []Comparison{}
+	for _, k := range keys {
+		list = append(list, Comparison{Key: k, A: a[k], B: b[k], Same: a[k] == b[k]})
+	}
+	return list
+}
+
+// compareCmd shows the configuration of two services side by side, such
+// as the same app deployed as dev-api and prod-api.
+func compareCmd(args []string) {
+	if len(args) != 2 {
+		ext.Die("compare takes two services, [PROJECT/]SERVICE[@REGION]")
+	}
+	a, b := parseTarget(args[0]), parseTarget(args[1])
+	list := compare(
+		flatten(serviceInfo(a.Service, a.Project, a.Region).Spec.Template),
+		flatten(serviceInfo(b.Service, b.Project, b.Region).Spec.Template))
+	ext.Output(list, func() { printComparison(a.String(), b.String(), list) })
+}
+
+func printComparison(a, b string, list []Comparison) {
+	width := [2]int{len("KEY"), len(a)}
+	for _, cmp := range list {
+		width[0] = max(width[0], len(cmp.Key))
+		width[1] = max(width[1], len(cmp.A))
+	}
+	row := func(key, a, b string) string {
+		return fmt.Sprintf("%-*s  %-*s  %s", width[0], key, width[1], a, b)
+	}
+
+	fmt.Println(ext.Color(row("KEY", a, b), c.White))
+	differ := 0
+	for _, cmp := range list {
+		line := row(cmp.Key, cmp.A, cmp.B)
+		switch {
+		case cmp.Same:
+			fmt.Println(c.Gray(12, line))
+		case cmp.A == "" || cmp.B == "":
+			differ++
+			fmt.Println(c.Yellow(line))
+		default:
+			differ++
+			fmt.Println(c.Red(line))
+		}
+	}
+	if differ == 0 {
+		fmt.Println(c.Gray(12, "no differences"))
+	} else {
+		fmt.Printf("%d of %d settings differ\n", differ, len(list))
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"gcp/lib/ext"
+
+	c "github.com/logrusorgru/aurora/v4"
+)
+
+// configCmd shows every effective variable and the layer it came from.
+func configCmd() {
+	settings := ext.Settings()
+	ext.Output(settings, func() {
+		fmt.Println(c.Gray(12, ext.Precedence))
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, s := range settings {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", c.BrightYellow(s.Name), s.Value, c.Gray(12, s.Source))
+		}
+		w.Flush()
+	})
+}
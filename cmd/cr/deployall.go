@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"gcp/lib/ext"
+
+	c "github.com/logrusorgru/aurora/v4"
+	"golang.org/x/term"
+)
+
+var (
+	fAll      = flag.Bool("all", false, "with deploy, deploy every service in SERVICE_NAMES")
+	fServices = flag.String("services", "", "with deploy, deploy the comma separated `services`")
+	fWaves    = flag.Int("waves", 0, "with deploy to several regions, roll out in `n` waves (default one region per wave)")
+)
+
+// Rollout is the state of one service in a multi-service deploy.
+type Rollout struct {
+	Service string        `json:"service"`
+	Project string        `json:"project"`
+	Region  string        `json:"region"`
+	State   string        `json:"state"`
+	Error   string        `json:"error,omitempty"`
+	Elapsed time.Duration `json:"-"`
+	Seconds float64       `json:"seconds"`
+}
+
+const (
+	statePending    = "pending"
+	stateDeploying  = "deploying"
+	stateChecking   = "checking"
+	stateDeployed   = "deployed"
+	stateFailed     = "failed"
+	stateRolledBack = "rolled back"
+	stateSkipped    = "skipped"
+)
+
+// progress shows rollouts as a table redrawn in place on a terminal, or
+// as a line per change otherwise.
+type progress struct {
+	mu       sync.Mutex
+	rollouts []*Rollout
+	start    time.Time
+	width    int
+	live     bool
+	drawn    int
+}
+
+func newProgress(rollouts []*Rollout) *progress {
+	p := &progress{
+		rollouts: rollouts,
+		start:    time.Now(),
+		live:     !ext.Machine() && !ext.DryRun() && term.IsTerminal(int(os.Stdout.Fd())),
+	}
+	for _, r := range rollouts {
+		p.width = max(p.width, len(r.Service))
+	}
+	if p.live {
+		p.draw()
+	}
+	return p
+}
+
+func (p *progress) update(r *Rollout, state string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	r.State = state
+	if err != nil {
+		r.Error = failureReason(err)
+	}
+	r.Elapsed = time.Since(p.start)
+	r.Seconds = r.Elapsed.Round(100 * time.Millisecond).Seconds()
+	if p.live {
+		p.draw()
+		return
+	}
+	fmt.Fprintln(ext.Info(), p.line(r))
+}
+
+func (p *progress) draw() {
+	if p.drawn > 0 {
+		fmt.Printf("\033[%dA", p.drawn)
+	}
+	for _, r := range p.rollouts {
+		fmt.Printf("\033[2K%s\n", p.line(r))
+	}
+	p.drawn = len(p.rollouts)
+}
+
+func (p *progress) line(r *Rollout) string {
+	state := fmt.Sprintf("%-11s", r.State)
+	switch r.State {
+	case stateDeployed:
+		state = c.Green(state).String()
+	case stateFailed:
+		state = c.Red(state).String()
+	case stateRolledBack:
+		state = c.Yellow(state).String()
+	case statePending, stateSkipped:
+		state = c.Gray(12, state).String()
+	default:
+		state = c.Cyan(state).String()
+	}
+	line := fmt.Sprintf("%-*s %s %6s %s/%s", p.width, r.Service, state,
+		r.Elapsed.Round(time.Second), r.Project, r.Region)
+	if r.Error != "" {
+		line += " " + c.Red(firstLine(r.Error)).String()
+	}
+	return line
+}
+
+// failureReason puts the last line of stderr ahead of err, since a
+// failed command only says which command it was and its exit status.
+func failureReason(err error) string {
+	var cmd *ext.CommandError
+	if errors.As(err, &cmd) && cmd.Stderr != "" {
+		lines := strings.Split(strings.TrimSpace(cmd.Stderr), "\n")
+		return strings.TrimSpace(lines[len(lines)-1]) + "\n" + err.Error()
+	}
+	return err.Error()
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
+
+// deployAllCmd deploys one image to several services or regions at
+// once. Regions go in waves, and a wave starts only when every service
+// in the one before is deployed. When deploys are verified, each service
+// is health checked and rolled back on its own, like a single deploy.
+func deployAllCmd() {
+	var services []string
+	switch {
+	case *fServices != "":
+		services = strings.Split(*fServices, ",")
+	case *fAll:
+		services = ext.SERVICES()
+	default:
+		services = []string{ext.SERVICE()}
+	}
+
+	rollouts := []*Rollout{}
+	for _, service := range services {
+		for _, region := range ext.RegionsFor(service) {
+			rollouts = append(rollouts, &Rollout{
+				Service: service,
+				Project: ext.ProjectFor(service),
+				Region:  region,
+				State:   statePending,
+			})
+		}
+	}
+	waves := inWaves(rollouts, *fWaves)
+	for i, wave := range waves {
+		fmt.Fprintln(ext.Info(), ext.Color(fmt.Sprintf("wave %d", i+1), c.Blue))
+		for _, r := range wave {
+			fmt.Fprintln(ext.Info(), " ", ext.Color(r.Service, c.Yellow), r.Project+"/"+r.Region)
+		}
+	}
+
+	image := pickImage("")
+	message := fmt.Sprintf("deploy [%s] to %d services", ext.Color(image, c.Yellow), len(rollouts))
+	if !ext.ConfirmService(message, strings.Join(services, ",")) {
+		return
+	}
+
+	h := healthCheck()
+	p := newProgress(rollouts)
+	for _, wave := range waves {
+		var wg sync.WaitGroup
+		for _, r := range wave {
+			if r.State == stateSkipped {
+				continue
+			}
+			wg.Go(func() {
+				var err error
+				defer func() {
+					if err != nil {
+						p.update(r, stateFailed, err)
+					}
+				}()
+				defer ext.Catch(&err)
+				rollout(ext.Context(), p, h, r, image)
+			})
+		}
+		wg.Wait()
+		if !allDeployed(wave) {
+			for _, r := range rollouts {
+				if r.State == statePending {
+					p.update(r, stateSkipped, nil)
+				}
+			}
+		}
+	}
+
+	count := map[string]int{}
+	for _, r := range rollouts {
+		count[r.State]++
+	}
+	failed := len(rollouts) - count[stateDeployed]
+	ext.Output(rollouts, func() {
+		fmt.Printf("\n%d deployed, %d rolled back, %d failed, %d skipped in %s\n",
+			count[stateDeployed], count[stateRolledBack], count[stateFailed], count[stateSkipped],
+			time.Since(p.start).Round(time.Second))
+		for _, r := range rollouts {
+			if r.Error != "" {
+				fmt.Printf("  %s %s/%s: %s\n", r.Service, r.Project, r.Region, ext.Color(firstLine(r.Error), c.Red))
+			}
+		}
+	})
+	if failed > 0 {
+		ext.Notify(fmt.Sprintf("deploy failed for %d services", failed))
+		ext.Fail(fmt.Errorf("%d of %d services did not deploy", failed, len(rollouts)))
+	}
+	ext.Notify(fmt.Sprintf("deployed %d services", len(rollouts)))
+}
+
+// inWaves groups rollouts by region into n waves, keeping the order in
+// which regions are configured. With n of 0 each region is a wave.
+func inWaves(rollouts []*Rollout, n int) [][]*Rollout {
+	regions := []string{}
+	for _, r := range rollouts {
+		if !slices.Contains(regions, r.Region) {
+			regions = append(regions, r.Region)
+		}
+	}
+	if n <= 0 || n > len(regions) {
+		n = len(regions)
+	}
+	size := (len(regions) + n - 1) / n
+	waves := make([][]*Rollout, n)
+	for _, r := range rollouts {
+		i := slices.Index(regions, r.Region) / size
+		waves[i] = append(waves[i], r)
+	}
+	return slices.DeleteFunc(waves, func(wave []*Rollout) bool { return len(wave) == 0 })
+}
+
+func allDeployed(rollouts []*Rollout) bool {
+	for _, r := range rollouts {
+		if r.State != stateDeployed {
+			return false
+		}
+	}
+	return true
+}
+
+// rollout deploys image to one service. When h verifies deploys, it then
+// checks its health and sends traffic back to the revisions serving
+// before if it is not healthy.
+func rollout(ctx context.Context, p *progress, h HealthCheck, r *Rollout, image string) {
+	p.update(r, stateDeploying, nil)
+	before, err := describeService(ctx, r.Service, r.Project, r.Region)
+	if err != nil {
+		p.update(r, stateFailed, err)
+		return
+	}
+	if err := ext.MutateContext(ctx, deploy(r.Service, image, r.Project, r.Region)); err != nil {
+		p.update(r, stateFailed, err)
+		return
+	}
+	if ext.DryRun() || !h.Verify {
+		p.update(r, stateDeployed, nil)
+		return
+	}
+
+	p.update(r, stateChecking, nil)
+	after, err := describeService(ctx, r.Service, r.Project, r.Region)
+	if err == nil {
+		err = h.await(io.Discard, after.Status.Address.URL)
+	}
+	if err == nil {
+		p.update(r, stateDeployed, nil)
+		return
+	}
+	revert := toRevisions(before.Status.Traffic)
+	if revert == "" {
+		p.update(r, stateFailed, err)
+		return
+	}
+	if rerr := ext.MutateContext(ctx, updateTrafficCmd(r.Service, r.Project, r.Region, "--to-revisions "+revert)); rerr != nil {
+		p.update(r, stateFailed, errors.Join(err, rerr))
+		return
+	}
+	p.update(r, stateRolledBack, err)
+}
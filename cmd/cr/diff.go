@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gcp/lib/ext"
+
+	c "github.com/logrusorgru/aurora/v4"
+)
+
+// Change is a setting that differs between two revisions.
+type Change struct {
+	Key    string `json:"key"`
+	Before string `json:"before,omitempty"`
+	After  string `json:"after,omitempty"`
+}
+
+// noisyAnnotations change with every revision without changing it.
+var noisyAnnotations = []string{
+	"client.knative.dev/user-image",
+	"run.googleapis.com/client-name",
+	"run.googleapis.com/client-version",
+	"run.googleapis.com/operation-id",
+	"serving.knative.dev/creator",
+	"serving.knative.dev/lastModifier",
+}
+
+// flatten turns a revision spec into keys like env.NAME and limits.cpu,
+// so that two specs can be compared setting by setting.
+func flatten(t Template) map[string]string {
+	flat := map[string]string{}
+	put := func(key, value string) {
+		if value != "" {
+			flat[key] = value
+		}
+	}
+	put("serviceAccount", t.Spec.ServiceAccountName)
+	if t.Spec.ContainerConcurrency > 0 {
+		put("concurrency", strconv.Itoa(t.Spec.ContainerConcurrency))
+	}
+
+	aliases := secretAliases(t)
+	for i, container := range t.Spec.Containers {
+		prefix := ""
+		if i > 0 {
+			prefix = fmt.Sprintf("container%d.", i)
+		}
+		put(prefix+"image", container.Image)
+		for j, p := range container.Ports {
+			key := prefix + "port"
+			if j > 0 {
+				key += strconv.Itoa(j)
+			}
+			put(key, strconv.Itoa(p.ContainerPort))
+		}
+		for k, v := range container.Resources.Limits {
+			put(prefix+"limits."+k, v)
+		}
+		for _, e := range container.Env {
+			if e.ValueFrom == nil {
+				flat[prefix+"env."+e.Name] = e.Value
+				continue
+			}
+			ref := e.ValueFrom.SecretKeyRef
+			secret := aliases[ref.Name]
+			if secret == "" {
+				secret = ref.Name
+			}
+			put(prefix+"secret."+e.Name, secret+":"+ref.Key)
+		}
+	}
+
+	for k, v := range t.Metadata.Annotations {
+		switch k {
+		case "autoscaling.knative.dev/minScale":
+			put("scaling.min", v)
+		case "autoscaling.knative.dev/maxScale":
+			put("scaling.max", v)
+		case "run.googleapis.com/secrets":
+			// Resolved into secret.NAME above.
+		default:
+			if !slices.Contains(noisyAnnotations, k) {
+				put("annotation."+k, v)
+			}
+		}
+	}
+	return flat
+}
+
+// changes lists the keys whose values differ, sorted.
+func changes(before, after map[string]string) []Change {
+	keys := slices.Sorted(maps.Keys(before))
+	for k := range after {
+		if _, ok := before[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+
+	list := []Change{}
+	for _, k := range keys {
+		if before[k] != after[k] {
+			list = append(list, Change{Key: k, Before: before[k], After: after[k]})
+		}
+	}
+	return list
+}
+
+func printChanges(a, b string, list []Change) {
+	fmt.Println(ext.Color("--- "+a, c.White))
+	fmt.Println(ext.Color("+++ "+b, c.White))
+	for _, ch := range list {
+		if ch.Before != "" {
+			fmt.Println(c.Red("- " + ch.Key + ": " + ch.Before))
+		}
+		if ch.After != "" {
+			fmt.Println(c.Green("+ " + ch.Key + ": " + ch.After))
+		}
+	}
+	if len(list) == 0 {
+		fmt.Println(c.Gray(12, "no differences"))
+	}
+}
+
+func describeRevision(revision, project, region string) (r Revision) {
+	cmd := fmt.Sprintf(
+		"gcloud run revisions describe %s --region %s --project %s --format json",
+		revision, region, project)
+	ext.Check(json.Unmarshal(ext.Capture(cmd, true), &r))
+	return r
+}
+
+// diffCmd compares two revisions. With no arguments it compares the
+// serving revision with the one before it, with one it compares that
+// revision with the serving one. diff spec compares the service with
+// its spec file.
+func diffCmd(args []string) {
+	serviceName := ext.SERVICE()
+	project := ext.PROJECT()
+	region := ext.REGION()
+
+	if len(args) > 0 && args[0] == "spec" {
+		diffSpec(serviceName, project, region)
+		return
+	}
+	if len(args) > 2 {
+		ext.Die("diff takes at most two revisions, not %s", strings.Join(args, " "))
+	}
+
+	service := serviceInfo(serviceName, project, region)
+	percent := trafficPercent(service)
+	var a, b string
+	switch len(args) {
+	case 2:
+		a, b = args[0], args[1]
+	case 1:
+		a, b = args[0], servingRevision(service)
+	default:
+		previous, ok := previousRevision(queryRevisions(serviceName, project, region), percent)
+		if !ok {
+			ext.Die("no earlier ready revision of %s to compare with", serviceName)
+		}
+		a, b = previous.Name(), servingRevision(service)
+	}
+
+	list := changes(
+		flatten(describeRevision(a, project, region).Template),
+		flatten(describeRevision(b, project, region).Template))
+	ext.Output(list, func() { printChanges(a, b, list) })
+}
+
+// servingRevision returns the revision receiving the most traffic.
+func servingRevision(service Service) string {
+	name, most := service.Status.LatestReadyRevisionName, 0
+	for revision, p := range trafficPercent(service) {
+		if p > most {
+			name, most = revision, p
+		}
+	}
+	return name
+}
+
+func diffSpec(serviceName, project, region string) {
+	want := loadSpec(serviceName)
+	service := serviceInfo(serviceName, project, region)
+	vars := serviceVariables(serviceName, project, region, service)
+	live := liveSpec(service, vars, publicService(serviceName, project, region), want)
+	if ext.Machine() {
+		ext.Output(changes(specFields(live), specFields(want)), nil)
+		return
+	}
+	fmt.Print(ext.Diff(specFile(serviceName), renderSpec(live), renderSpec(want)))
+}
+
+// specFields flattens a spec through its json form.
+func specFields(s Spec) map[string]string {
+	b, err := json.Marshal(s)
+	ext.Check(err)
+	var m map[string]any
+	ext.Check(json.Unmarshal(b, &m))
+	flat := map[string]string{}
+	for k, v := range m {
+		if table, ok := v.(map[string]any); ok {
+			for tk, tv := range table {
+				flat[k+"."+tk] = fmt.Sprint(tv)
+			}
+			continue
+		}
+		flat[k] = fmt.Sprint(v)
+	}
+	return flat
+}
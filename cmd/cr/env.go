@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"gcp/lib/ext"
+
+	c "github.com/logrusorgru/aurora/v4"
+)
+
+// envCmd changes the environment of the service without a redeploy:
+//
+//	env set KEY=VALUE...   set or change variables
+//	env unset KEY...       remove variables, or unbind secrets
+//	env import FILE        set the variables of a .env file
+//	env export             print the variables as a .env file
+func envCmd(args []string) {
+	if len(args) == 0 {
+		ext.Die("env takes set, unset, import or export")
+	}
+	serviceName := ext.SERVICE()
+	project := ext.PROJECT()
+	region := ext.REGION()
+	v := serviceVariables(serviceName, project, region, serviceInfo(serviceName, project, region))
+
+	if args[0] == "export" {
+		live := map[string]string{}
+		for _, e := range v.Env {
+			live[e.Name] = e.Value
+		}
+		ext.Output(live, func() {
+			for _, k := range slices.Sorted(maps.Keys(live)) {
+				fmt.Printf("%s=%s\n", k, quote(live[k]))
+			}
+		})
+		return
+	}
+
+	list, cmd := envUpdate(serviceName, project, region, v, args[0], args[1:])
+	if len(list) == 0 {
+		fmt.Println(c.Gray(12, "no changes"))
+		return
+	}
+	printChanges(serviceName+" (live)", serviceName, list)
+	if !ext.ConfirmService(fmt.Sprintf("update %d variables of [%s]", len(list), ext.Color(serviceName, c.Yellow)), serviceName) {
+		return
+	}
+	ext.Mutate(cmd)
+
+	ext.Notify("environment updated")
+}
+
+// envUpdate returns the changes env sub makes to the variables v and the
+// command making them. A variable set from a secret has to be unset
+// before it can be given a plain value, as gcloud will not change its type.
+func envUpdate(serviceName, project, region string, v Variables, sub string, args []string) ([]Change, string) {
+	live := map[string]string{}
+	for _, e := range v.Env {
+		live[e.Name] = e.Value
+	}
+	secrets := map[string]string{}
+	for _, s := range v.Secrets {
+		secrets[s.Env] = s.Secret + ":" + s.Version
+	}
+	want := maps.Clone(live)
+	unbind := []string{}
+
+	switch sub {
+	case "set":
+		for _, kv := range args {
+			k, v, ok := strings.Cut(kv, "=")
+			if !ok || k == "" {
+				ext.Die("env set takes KEY=VALUE, not %s", kv)
+			}
+			want[k] = v
+		}
+	case "unset":
+		for _, k := range args {
+			if _, ok := secrets[k]; ok {
+				unbind = append(unbind, k)
+			}
+			delete(want, k)
+		}
+	case "import":
+		if len(args) != 1 {
+			ext.Die("env import takes one file")
+		}
+		vars, err := ext.ReadVariables(args[0])
+		ext.Check(err)
+		maps.Copy(want, vars)
+	default:
+		ext.Die("unknown env command: %s", sub)
+	}
+
+	for _, k := range slices.Sorted(maps.Keys(want)) {
+		if secret, ok := secrets[k]; ok {
+			ext.Die("%s is set from secret %s, run cr env unset %s before giving it a value", k, secret, k)
+		}
+	}
+
+	list := changes(live, want)
+	flags := dictFlags("env-vars", live, want)
+	slices.Sort(unbind)
+	for _, k := range unbind {
+		list = append(list, Change{Key: k, Before: secrets[k]})
+	}
+	if len(unbind) > 0 {
+		flags = append(flags, "--remove-secrets", quote(strings.Join(unbind, ",")))
+	}
+	cmd := fmt.Sprintf("gcloud run services update %s --region %s --project %s %s",
+		serviceName, region, project, strings.Join(flags, " "))
+	return list, cmd
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gcp/lib/ext"
+
+	c "github.com/logrusorgru/aurora/v4"
+)
+
+// HealthCheck describes a healthy answer. It is configured with
+//
+//	HEALTH_PATH     path to probe, default /health
+//	HEALTH_METHOD   http method, default GET
+//	HEALTH_HEADERS  extra headers, one "Name: value" per line, e.g.
+//	                "Accept: text/plain\nCookie: a=1; b=2"
+//	HEALTH_AUTH     "identity" to always send an identity token, which
+//	                is otherwise sent only after a 401 or 403
+//	HEALTH_STATUS   accepted status codes, comma separated, default 200
+//	HEALTH_LATENCY  slowest acceptable answer, e.g. 500ms
+//	HEALTH_JSON     json fields and their values, e.g. status=ok,db.ok=true
+//	HEALTH_BODY     text the body has to contain
+//	HEALTH_TIMEOUT  how long to poll after a deploy, default 2m
+//	HEALTH_INTERVAL pause between polls, default 5s
+//	HEALTH_VERIFY   "on" or "off", whether deploys wait for the service to
+//	                be healthy and roll back if it is not; on by default
+//	                only when HEALTH_PATH is set, off with --no-verify
+type HealthCheck struct {
+	Path     string
+	Method   string
+	Headers  http.Header
+	Identity bool
+	Status   []int
+	Latency  time.Duration
+	JSON     [][2]string
+	Body     string
+	Timeout  time.Duration
+	Interval time.Duration
+	Verify   bool
+}
+
+// Probe is the outcome of one request.
+type Probe struct {
+	Time      time.Time     `json:"time"`
+	Status    int           `json:"status"`
+	Latency   time.Duration `json:"-"`
+	LatencyMS int64         `json:"latencyMs"`
+	Body      any           `json:"body,omitempty"`
+	Error     string        `json:"error,omitempty"`
+}
+
+const healthTimeout = 30 * time.Second
+
+var (
+	fWatch    = flag.Bool("watch", false, "with health, probe every HEALTH_INTERVAL until interrupted")
+	fNoVerify = flag.Bool("no-verify", false, "with deploy, do not wait for the service to be healthy or roll back")
+)
+
+func healthCheck() HealthCheck {
+	h := HealthCheck{
+		Path:     "/health",
+		Method:   http.MethodGet,
+		Headers:  http.Header{},
+		Status:   []int{http.StatusOK},
+		Timeout:  2 * time.Minute,
+		Interval: 5 * time.Second,
+	}
+	if v, err := ext.Lookup("HEALTH_PATH"); err == nil {
+		h.Path = "/" + strings.TrimPrefix(v, "/")
+		h.Verify = true
+	}
+	if v, err := ext.Lookup("HEALTH_VERIFY"); err == nil {
+		if v != "on" && v != "off" {
+			ext.Die("invalid HEALTH_VERIFY, expected on or off, not %s", v)
+		}
+		h.Verify = v == "on"
+	}
+	if *fNoVerify {
+		h.Verify = false
+	}
+	if v, err := ext.Lookup("HEALTH_METHOD"); err == nil {
+		h.Method = strings.ToUpper(v)
+	}
+	if v, err := ext.Lookup("HEALTH_HEADERS"); err == nil {
+		for header := range strings.Lines(v) {
+			if strings.TrimSpace(header) == "" {
+				continue
+			}
+			name, value, ok := strings.Cut(header, ":")
+			if !ok {
+				ext.Die("invalid HEALTH_HEADERS, expected Name: value, not %s", header)
+			}
+			h.Headers.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+		}
+	}
+	if v, err := ext.Lookup("HEALTH_AUTH"); err == nil {
+		if v != "identity" {
+			ext.Die("invalid HEALTH_AUTH, expected identity, not %s", v)
+		}
+		h.Identity = true
+	}
+	if v, err := ext.Lookup("HEALTH_STATUS"); err == nil {
+		h.Status = nil
+		for status := range strings.SplitSeq(v, ",") {
+			h.Status = append(h.Status, ext.Atoi(strings.TrimSpace(status)))
+		}
+	}
+	if v, err := ext.Lookup("HEALTH_JSON"); err == nil {
+		for assertion := range strings.SplitSeq(v, ",") {
+			field, value, ok := strings.Cut(assertion, "=")
+			if !ok {
+				ext.Die("invalid HEALTH_JSON, expected FIELD=VALUE, not %s", assertion)
+			}
+			h.JSON = append(h.JSON, [2]string{strings.TrimSpace(field), strings.TrimSpace(value)})
+		}
+	}
+	if v, err := ext.Lookup("HEALTH_BODY"); err == nil {
+		h.Body = v
+	}
+	h.Latency = healthDuration("HEALTH_LATENCY", 0)
+	h.Timeout = healthDuration("HEALTH_TIMEOUT", h.Timeout)
+	h.Interval = healthDuration("HEALTH_INTERVAL", h.Interval)
+	return h
+}
+
+func healthDuration(name string, fallback time.Duration) time.Duration {
+	v, err := ext.Lookup(name)
+	if err != nil {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		ext.Die("invalid %s: %v", name, err)
+	}
+	return d
+}
+
+// probe checks the service at base url once, within ctx. The body is
+// decoded json, or the text itself if it is not json.
+func (h HealthCheck) probe(ctx context.Context, base string) (Probe, error) {
+	url := base + h.Path
+	p := Probe{Time: time.Now()}
+	status, body, err := authorized(ctx, h.Method, url, base, h.Headers, h.Identity)
+	p.Latency = time.Since(p.Time)
+	p.LatencyMS = p.Latency.Milliseconds()
+	if err != nil {
+		return p, err
+	}
+	p.Status = status
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		v = strings.TrimSpace(string(body))
+	}
+	if v != "" {
+		p.Body = v
+	}
+	if !slices.Contains(h.Status, status) {
+		return p, fmt.Errorf("%s: status %d, expected %v", url, status, h.Status)
+	}
+	if h.Latency > 0 && p.Latency > h.Latency {
+		return p, fmt.Errorf("%s: took %s, expected under %s", url, p.Latency.Round(time.Millisecond), h.Latency)
+	}
+	for _, assertion := range h.JSON {
+		if got := field(v, assertion[0]); got != assertion[1] {
+			return p, fmt.Errorf("%s: %s is %q, expected %q", url, assertion[0], got, assertion[1])
+		}
+	}
+	if h.Body != "" && !strings.Contains(string(body), h.Body) {
+		return p, fmt.Errorf("%s: body does not contain %q", url, h.Body)
+	}
+	return p, nil
+}
+
+// await polls the service at base url until it is healthy or the
+// timeout runs out, logging each failed probe to w.
+func (h HealthCheck) await(w io.Writer, base string) error {
+	ctx, cancel := ext.WithTimeout(h.Timeout)
+	defer cancel()
+
+	fmt.Fprintln(w, "\n"+ext.Color("await ", c.Blue)+ext.Color(base+h.Path, c.White))
+	for {
+		_, err := h.probe(ctx, base)
+		if err == nil {
+			fmt.Fprintln(w, ext.Color("healthy", c.Green))
+			return nil
+		}
+		fmt.Fprintln(w, c.Gray(12, err.Error()))
+		if ext.Sleep(ctx, h.Interval) != nil {
+			return fmt.Errorf("not healthy after %s: %w", h.Timeout, err)
+		}
+	}
+}
+
+// watch probes the service at base url until interrupted, printing a
+// line per probe.
+func (h HealthCheck) watch(base string) {
+	fmt.Println("\n" + ext.Color("watch ", c.Blue) + ext.Color(h.Method+" "+base+h.Path, c.White))
+	var probes, failures int
+	var total, slowest time.Duration
+	for {
+		p, err := h.probe(ext.Context(), base)
+		probes++
+		total += p.Latency
+		slowest = max(slowest, p.Latency)
+		if ext.Machine() {
+			if err != nil {
+				p.Error = err.Error()
+			}
+			b, merr := json.Marshal(p)
+			ext.Check(merr)
+			fmt.Println(string(b))
+		} else {
+			line := fmt.Sprintf("%s %3d %8s", p.Time.Format(time.TimeOnly), p.Status, p.Latency.Round(time.Millisecond))
+			if err != nil {
+				failures++
+				fmt.Println(ext.Color(line+" "+err.Error(), c.Red))
+			} else {
+				fmt.Println(ext.Color(line, c.Green))
+			}
+		}
+		if ext.Sleep(ext.Context(), h.Interval) != nil {
+			break
+		}
+	}
+	fmt.Fprintf(ext.Info(), "\n%d probes, %d failed, average %s, slowest %s\n",
+		probes, failures, (total / time.Duration(probes)).Round(time.Millisecond), slowest.Round(time.Millisecond))
+}
+
+// field returns the value at a dotted path in decoded json.
+func field(v any, path string) string {
+	for key := range strings.SplitSeq(path, ".") {
+		switch node := v.(type) {
+		case map[string]any:
+			v = node[key]
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return ""
+			}
+			v = node[i]
+		default:
+			return ""
+		}
+	}
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+func healthCmd() {
+	service := serviceInfo(ext.SERVICE(), ext.PROJECT(), ext.REGION())
+	if *fWatch {
+		healthCheck().watch(service.Status.Address.URL)
+		return
+	}
+	printHealth(service)
+}
+
+func queryHealth(service Service) (any, error) {
+	p, err := healthCheck().probe(ext.Context(), service.Status.Address.URL)
+	return p.Body, err
+}
+
+func printHealth(service Service) {
+	ext.Check(checkHealth(service.Status.Address.URL))
+}
+
+// checkHealth prints the health answer of the service at base url.
+func checkHealth(base string) error {
+	h := healthCheck()
+	fmt.Println("\n" + ext.Color(h.Method+" ", c.Blue) + ext.Color(base+h.Path, c.White))
+
+	p, err := h.probe(ext.Context(), base)
+	switch body := p.Body.(type) {
+	case nil:
+	case string:
+		fmt.Println(body)
+	default:
+		b, merr := json.MarshalIndent(body, "", "  ")
+		if merr != nil {
+			return merr
+		}
+		fmt.Println(string(b))
+	}
+	if p.Status != 0 {
+		fmt.Println(c.Gray(12, fmt.Sprintf("%d in %s", p.Status, p.Latency.Round(time.Millisecond))))
+	}
+	return err
+}
+
+// verifyDeploy polls the health of a freshly deployed service, if deploys
+// are verified. If it does not become healthy, traffic goes back to the
+// revisions in revert, a --to-revisions split.
+func verifyDeploy(serviceName, project, region, revert string) {
+	h := healthCheck()
+	if !h.Verify {
+		return
+	}
+	service := serviceInfo(serviceName, project, region)
+	err := h.await(os.Stdout, service.Status.Address.URL)
+	if err == nil {
+		return
+	}
+	fmt.Println(ext.Color("health check failed: "+err.Error(), c.Red))
+	if revert == "" {
+		ext.Notify("deploy is unhealthy")
+		ext.Fail(fmt.Errorf("deploy is unhealthy: %w", err))
+	}
+	fmt.Println(ext.Color("rolling back to "+revert, c.Yellow))
+	updateTraffic(serviceName, project, region, "--to-revisions "+revert)
+	ext.Notify("deploy is unhealthy, rolled back")
+	ext.Fail(fmt.Errorf("deploy is unhealthy, rolled back to %s: %w", revert, err))
+}
+
+// authorized makes a request, sending an identity token for audience
+// when identity is set or when the service turns the request down.
+func authorized(ctx context.Context, method, url, audience string, headers http.Header, identity bool) (int, []byte, error) {
+	headers = headers.Clone()
+	if headers == nil {
+		headers = http.Header{}
+	}
+	if !identity {
+		status, body, err := httpDo(ctx, method, url, headers)
+		if err != nil || (status != http.StatusUnauthorized && status != http.StatusForbidden) {
+			return status, body, err
+		}
+	}
+	token, err := identityToken(audience)
+	if err != nil {
+		return 0, nil, err
+	}
+	headers.Set("Authorization", "Bearer "+token)
+	return httpDo(ctx, method, url, headers)
+}
+
+// httpDo makes a request that gives up after healthTimeout, or earlier
+// if ctx is done first.
+func httpDo(ctx context.Context, method, url string, headers http.Header) (int, []byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header = headers
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, body, err
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"gcp/lib/ext"
+
+	c "github.com/logrusorgru/aurora/v4"
+)
+
+var (
+	fFollow   = flag.Bool("f", false, "with logs, keep polling for new entries")
+	fRevision = flag.String("revision", "", "with logs, only entries of this `revision`")
+	fSeverity = flag.String("severity", "", "with logs, only entries at this `level` or above, e.g. WARNING")
+	fGrep     = flag.String("grep", "", "with logs, only entries containing `text`")
+	fSince    = flag.Duration("since", time.Hour, "with logs, how far back to read")
+	fLimit    = flag.Int("limit", 100, "with logs, the most entries to read")
+)
+
+const logsInterval = 5 * time.Second
+
+// LogEntry is a Cloud Logging entry as printed by gcloud logging read.
+type LogEntry struct {
+	InsertID    string         `json:"insertId"`
+	Timestamp   time.Time      `json:"timestamp"`
+	Severity    string         `json:"severity"`
+	LogName     string         `json:"logName"`
+	TextPayload string         `json:"textPayload,omitempty"`
+	JSONPayload map[string]any `json:"jsonPayload,omitempty"`
+	HTTPRequest *struct {
+		RequestMethod string `json:"requestMethod"`
+		RequestURL    string `json:"requestUrl"`
+		Status        int    `json:"status"`
+		Latency       string `json:"latency"`
+	} `json:"httpRequest,omitempty"`
+	Trace    string `json:"trace,omitempty"`
+	Resource struct {
+		Labels map[string]string `json:"labels"`
+	} `json:"resource"`
+}
+
+// logFilter selects the entries of a service newer than since.
+func logFilter(service, region string, since time.Time) string {
+	filter := []string{
+		`resource.type="cloud_run_revision"`,
+		fmt.Sprintf(`resource.labels.service_name="%s"`, service),
+		fmt.Sprintf(`resource.labels.location="%s"`, region),
+		fmt.Sprintf(`timestamp>="%s"`, since.UTC().Format(time.RFC3339Nano)),
+	}
+	if *fRevision != "" {
+		filter = append(filter, fmt.Sprintf(`resource.labels.revision_name="%s"`, *fRevision))
+	}
+	if *fSeverity != "" {
+		filter = append(filter, "severity>="+strings.ToUpper(*fSeverity))
+	}
+	if *fGrep != "" {
+		filter = append(filter, fmt.Sprintf("%q", *fGrep))
+	}
+	return strings.Join(filter, " AND ")
+}
+
+// readLogs returns the newest limit entries matching filter, oldest
+// first. With a limit of 0 it returns all of them, which is how follow
+// mode polls so that a burst between two polls is not cut short.
+func readLogs(filter, project string, limit int, echo bool) []LogEntry {
+	cmd := fmt.Sprintf("gcloud logging read %s --project %s --format json", quote(filter), project)
+	if limit == 0 {
+		cmd += " --order asc"
+	} else {
+		cmd += fmt.Sprintf(" --limit %d --order desc", limit)
+	}
+	entries := []LogEntry{}
+	ext.Check(json.Unmarshal(ext.Capture(cmd, echo), &entries))
+	if limit > 0 {
+		slices.Reverse(entries)
+	}
+	return entries
+}
+
+func logsCmd() {
+	serviceName := ext.SERVICE()
+	project := ext.PROJECT()
+	region := ext.REGION()
+
+	since := time.Now().Add(-*fSince)
+	entries := readLogs(logFilter(serviceName, region, since), project, *fLimit, true)
+	if !*fFollow {
+		ext.Output(entries, func() {
+			for _, e := range entries {
+				printLogEntry(e, project)
+			}
+		})
+		return
+	}
+
+	seen := map[string]bool{}
+	for {
+		for _, e := range entries {
+			if seen[e.InsertID] {
+				continue
+			}
+			seen[e.InsertID] = true
+			if e.Timestamp.After(since) {
+				since = e.Timestamp
+			}
+			if ext.Machine() {
+				b, err := json.Marshal(e)
+				ext.Check(err)
+				fmt.Println(string(b))
+			} else {
+				printLogEntry(e, project)
+			}
+		}
+		if ext.Sleep(ext.Context(), logsInterval) != nil {
+			return
+		}
+		// Entries at the last timestamp are read again, seen drops them.
+		entries = readLogs(logFilter(serviceName, region, since), project, 0, false)
+	}
+}
+
+func printLogEntry(e LogEntry, project string) {
+	stamp := ext.Href(logLink(e, project), e.Timestamp.Local().Format("15:04:05.000"))
+	line := []string{stamp, severity(e.Severity)}
+	if trace := traceID(e.Trace); trace != "" {
+		link := fmt.Sprintf("%s/traces/list?tid=%s&project=%s", ext.ConsoleURL, trace, project)
+		line = append(line, c.Gray(12, ext.Href(link, trace[:min(8, len(trace))])).String())
+	}
+	line = append(line, message(e))
+	fmt.Println(strings.Join(line, " "))
+}
+
+func severity(s string) string {
+	if s == "" {
+		s = "DEFAULT"
+	}
+	padded := fmt.Sprintf("%-7.7s", s)
+	switch s {
+	case "DEBUG":
+		return c.Gray(12, padded).String()
+	case "INFO", "NOTICE":
+		return c.Blue(padded).String()
+	case "WARNING":
+		return c.Yellow(padded).String()
+	case "ERROR", "CRITICAL", "ALERT", "EMERGENCY":
+		return c.Red(padded).Bold().String()
+	}
+	return padded
+}
+
+// message renders the payload: the text, the request, or the message of
+// a structured entry followed by its other fields.
+func message(e LogEntry) string {
+	if e.HTTPRequest != nil {
+		r := e.HTTPRequest
+		status := fmt.Sprint(r.Status)
+		if r.Status >= 500 {
+			status = c.Red(status).String()
+		} else if r.Status >= 400 {
+			status = c.Yellow(status).String()
+		}
+		return fmt.Sprintf("%s %s %s %s", r.RequestMethod, status, r.Latency, r.RequestURL)
+	}
+	if e.JSONPayload == nil {
+		return strings.TrimRight(e.TextPayload, "\n")
+	}
+	text := ""
+	fields := []string{}
+	for k, v := range e.JSONPayload {
+		if k == "message" || k == "msg" {
+			text = fmt.Sprint(v)
+			continue
+		}
+		b, _ := json.Marshal(v)
+		fields = append(fields, c.Gray(12, k+"=").String()+string(b))
+	}
+	sort.Strings(fields)
+	return strings.TrimSpace(text + " " + strings.Join(fields, " "))
+}
+
+func traceID(trace string) string {
+	_, id, ok := strings.Cut(trace, "/traces/")
+	if !ok {
+		return trace
+	}
+	return id
+}
+
+// logLink opens the entry in the Logs Explorer.
+func logLink(e LogEntry, project string) string {
+	query := url.PathEscape(fmt.Sprintf(`insertId="%s"`, e.InsertID))
+	return fmt.Sprintf("%s/logs/query;query=%s;cursorTimestamp=%s?project=%s",
+		ext.ConsoleURL, query, e.Timestamp.UTC().Format(time.RFC3339Nano), project)
+}
@@ -1,13 +1,12 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"gcp/lib/completion/zsh"
 	"gcp/lib/ext"
-	"io"
 	"io/fs"
 	"os"
 	"path"
@@ -19,34 +18,46 @@ import (
 	"github.com/AlecAivazis/survey/v2"
 	"github.com/briandowns/spinner"
 
-	"github.com/bitfield/script"
 	c "github.com/logrusorgru/aurora/v4"
 )
 
 func main() {
+	defer ext.Handle()
+
 	zsh.Completion(CompletionRoot)
 
 	flag.Usage = func() {
 		fmt.Printf("usage: %s command [command]...", os.Args[0])
 		fmt.Println("commands:")
 		fmt.Println("  h, health      /health")
-		fmt.Println("  r, revisions   list revisions")
+		fmt.Println("  r, revisions   list revisions, their images and traffic")
+		fmt.Println("  images         list images in the registry")
 		fmt.Println("  w, wait        wait for new iamge revision")
 		fmt.Println("  i, info        show service info")
-		fmt.Println("  d, deploy      deploy a revision (default)")
+		fmt.Println("  logs           show logs, -f to follow")
+		fmt.Println("  d, deploy      deploy a revision (default), --all or --services a,b for several")
 		fmt.Println("  b, bounce      bounce the service")
-		fmt.Println("  c, create      create a new service")
+		fmt.Println("  rollback       route traffic back to the previous revision")
+		fmt.Println("  traffic        show the traffic split per revision")
+		fmt.Println("  c, create      create a new service from its spec (service.toml)")
+		fmt.Println("  apply          update the service where it differs from its spec")
+		fmt.Println("  diff [a] [b]   compare two revisions, or the service and its spec with diff spec")
 		fmt.Println("  m, metadata    show image metadata")
 		fmt.Println("  t, terraform   cross-reference terraform")
+		fmt.Println("  t set TAG      set the image tags in terraform, or --from-running")
 		fmt.Println("  v, variables   show environment variables and secrets")
+		fmt.Println("  env ...        set, unset, import or export environment variables")
+		fmt.Println("  secrets ...    add, bind, pin, unpin or audit secrets")
+		fmt.Println("  compare A B    show the configuration of two services side by side")
 		fmt.Println("  init           create .cr file")
+		fmt.Println("  config         show variables and where they come from")
 		fmt.Println("  completion     generate completion script")
 		fmt.Println()
 		flag.PrintDefaults()
 	}
 	flag.Parse()
 
-	args := flag.Args()
+	args := ext.Args()
 	if len(args) == 0 {
 		args = []string{"d"}
 	}
@@ -56,9 +67,27 @@ func main() {
 		os.Exit(0)
 	}
 
+	if args[0] == "config" {
+		ext.LoadConfig()
+		configCmd()
+		return
+	}
+
 	ext.LoadVariables()
 
-	for _, cmd := range args {
+	for i, cmd := range args {
+		// These take the rest of the arguments as their own.
+		if run, ok := subcommands[cmd]; ok {
+			run(args[i+1:])
+			return
+		}
+		if cmd == "t" || cmd == "terraform" {
+			if i+1 < len(args) && args[i+1] == "set" {
+				terraformSetCmd(args[i+2:])
+				return
+			}
+		}
+
 		switch cmd {
 		case "h", "health":
 			healthCmd()
@@ -66,21 +95,36 @@ func main() {
 		case "r", "revisions":
 			revisionsCmd()
 
+		case "images":
+			imagesCmd()
+
 		case "w", "wait":
 			waitCmd()
 
 		case "i", "info":
 			infoCmd()
 
+		case "logs":
+			logsCmd()
+
 		case "d", "deploy":
 			deployCmd()
 
 		case "b", "bounce":
 			bounceCmd()
 
+		case "rollback":
+			rollbackCmd()
+
+		case "traffic":
+			trafficCmd()
+
 		case "c", "create":
 			createCmd()
 
+		case "apply":
+			applyCmd()
+
 		case "m", "metadata":
 			metadataCmd()
 
@@ -108,13 +152,11 @@ func queryService(service, project, region string) (b []byte, err error) {
 	cmd := fmt.Sprintf(
 		"gcloud run services describe %s --region %s --project %s --format json",
 		service, region, project)
-	return ext.Exec(cmd, true).Bytes()
+	return ext.Exec(cmd, true)
 }
 
 func serviceExists(service, project, region string) bool {
-	b, err := queryService(service, project, region)
-
-	fmt.Println(string(b))
+	_, err := queryService(service, project, region)
 	return err == nil
 }
 
@@ -126,6 +168,20 @@ func serviceInfo(service, project, region string) (s Service) {
 	return s
 }
 
+// describeService is serviceInfo for services handled side by side: the
+// command is not echoed and its failure is returned.
+func describeService(ctx context.Context, service, project, region string) (s Service, err error) {
+	cmd := fmt.Sprintf(
+		"gcloud run services describe %s --region %s --project %s --format json",
+		service, region, project)
+	b, err := ext.ExecContext(ctx, cmd, false)
+	if err != nil {
+		return s, err
+	}
+	err = json.Unmarshal(b, &s)
+	return s, err
+}
+
 func queryImages(echo bool) []Image {
 	cmd := fmt.Sprintf(``+
 		`gcloud artifacts docker images list %s `+
@@ -149,38 +205,65 @@ func textualizeVersions(images []Image) []string {
 type Service struct {
 	Metadata struct {
 		Annotations map[string]string `json:"annotations"`
+		Labels      map[string]string `json:"labels"`
 	} `json:"metadata"`
 	Spec struct {
-		Template struct {
-			Metadata struct {
-				Annotations map[string]string `json:"annotations"`
-			} `json:"metadata"`
-			Spec struct {
-				ServiceAccountName string `json:"serviceAccountName"`
-				Containers         []struct {
-					Image string `json:"image"`
-					Env   []struct {
-						Name      string `json:"name"`
-						Value     string `json:"value,omitempty"`
-						ValueFrom *struct {
-							SecretKeyRef struct {
-								Key  string `json:"key"`
-								Name string `json:"name"`
-							} `json:"secretKeyRef"`
-						} `json:"valueFrom,omitempty"`
-					} `json:"env"`
-				} `json:"containers"`
-			} `json:"spec"`
-		} `json:"template"`
+		Template Template `json:"template"`
 	} `json:"spec"`
 	Status struct {
 		Address struct {
 			URL string `json:"url"`
 		} `json:"address"`
+		LatestReadyRevisionName string    `json:"latestReadyRevisionName"`
+		Traffic                 []Traffic `json:"traffic"`
 	} `json:"status"`
 	URL string `json:"url"`
 }
 
+// Template is a revision spec, either the one in a service or a revision
+// listed on its own.
+type Template struct {
+	Metadata struct {
+		Name              string            `json:"name"`
+		CreationTimestamp time.Time         `json:"creationTimestamp"`
+		Annotations       map[string]string `json:"annotations"`
+	} `json:"metadata"`
+	Spec struct {
+		ServiceAccountName   string      `json:"serviceAccountName"`
+		ContainerConcurrency int         `json:"containerConcurrency"`
+		Containers           []Container `json:"containers"`
+	} `json:"spec"`
+}
+
+type Container struct {
+	Image string `json:"image"`
+	Ports []struct {
+		ContainerPort int `json:"containerPort"`
+	} `json:"ports"`
+	Resources struct {
+		Limits map[string]string `json:"limits"`
+	} `json:"resources"`
+	Env []struct {
+		Name      string `json:"name"`
+		Value     string `json:"value,omitempty"`
+		ValueFrom *struct {
+			SecretKeyRef struct {
+				Key  string `json:"key"`
+				Name string `json:"name"`
+			} `json:"secretKeyRef"`
+		} `json:"valueFrom,omitempty"`
+	} `json:"env"`
+}
+
+// Traffic is a traffic target in the service status.
+type Traffic struct {
+	RevisionName   string `json:"revisionName"`
+	Percent        int    `json:"percent"`
+	Tag            string `json:"tag,omitempty"`
+	LatestRevision bool   `json:"latestRevision,omitempty"`
+	URL            string `json:"url,omitempty"`
+}
+
 type Image struct {
 	UpdateTime string   `json:"updateTime"`
 	CreateTime string   `json:"createTime"`
@@ -192,9 +275,23 @@ type Image struct {
 	Version string `json:"version"`
 }
 
+// pickImage lets the user choose one of the latest images, returning its
+// reference by tag, or by digest if it has none.
+func pickImage(current string) string {
+	images := queryImages(true)
+
+	index, version := selectImage(images, current)
+	fmt.Fprintln(ext.Info(), ">", version)
+	delimiter := ":"
+	if strings.HasPrefix(version, "sha256") {
+		delimiter = "@"
+	}
+	return images[index].Package + delimiter + version
+}
+
 func selectImage(images []Image, current string) (int, string) {
 	if current != "" {
-		fmt.Println("running", ext.Color(current, c.Magenta))
+		fmt.Fprintln(ext.Info(), "running", ext.Color(current, c.Magenta))
 	}
 
 	imagesSelector := []string{}
@@ -225,7 +322,7 @@ func selectImage(images []Image, current string) (int, string) {
 	var selection string
 	err := survey.AskOne(prompt, &selection, survey.WithValidator(survey.Required))
 	ext.Check(err)
-	fmt.Println(selection)
+	fmt.Fprintln(ext.Info(), selection)
 
 	for i, v := range imagesSelector {
 		if v != selection {
@@ -309,6 +406,14 @@ func serviceLink(project, region, service string) string {
 
 // ---
 
+// subcommands are the commands with arguments of their own.
+var subcommands = map[string]func(args []string){
+	"env":     envCmd,
+	"secrets": secretsCmd,
+	"compare": compareCmd,
+	"diff":    diffCmd,
+}
+
 func deploy(service, image, project, region string) string {
 	return fmt.Sprintf(
 		"gcloud run deploy %s --image %s --region %s --project=%s",
@@ -316,6 +421,16 @@ func deploy(service, image, project, region string) string {
 }
 
 func deployCmd() {
+	if *fCanary < 0 || *fCanary >= 100 {
+		ext.Die("canary percent must be between 1 and 99, not %d", *fCanary)
+	}
+	if *fAll || *fServices != "" || len(ext.Regions()) > 1 {
+		if *fCanary > 0 {
+			ext.Die("canary deploys go to one service in one region at a time")
+		}
+		deployAllCmd()
+		return
+	}
 	serviceName := ext.SERVICE()
 	service := serviceInfo(serviceName, ext.PROJECT(), ext.REGION())
 
@@ -331,22 +446,22 @@ func deployCmd() {
 		fmt.Println(registryLink(currentImage))
 	}
 
-	images := queryImages(true)
+	image := pickImage(currentImage)
 
-	index, version := selectImage(images, currentImage)
-	fmt.Println(">", version)
-	delimiter := ":"
-	if strings.HasPrefix(version, "sha256") {
-		delimiter = "@"
+	if !ext.ConfirmService(fmt.Sprintf("deploy [%s]", ext.Color(image, c.Yellow)), serviceName) {
+		return
 	}
-	image := images[index].Package + delimiter + version
 
-	if !ext.Confirm(fmt.Sprintf("deploy [%s]", ext.Color(image, c.Yellow))) {
+	if *fCanary > 0 {
+		canaryDeploy(serviceName, image, ext.PROJECT(), ext.REGION(), *fCanary)
 		return
 	}
 
 	cmd := deploy(serviceName, image, ext.PROJECT(), ext.REGION())
-	ext.Run(cmd)
+	ext.Mutate(cmd)
+	if !ext.DryRun() {
+		verifyDeploy(serviceName, ext.PROJECT(), ext.REGION(), toRevisions(service.Status.Traffic))
+	}
 
 	ext.Notify("deployed")
 }
@@ -363,13 +478,13 @@ func bounceCmd() {
 	fmt.Println("image", ext.Color(image, c.Yellow))
 	fmt.Println(registryLink(image))
 
-	if !ext.Confirm(fmt.Sprintf("bounce [%s]", ext.Color(image, c.Yellow))) {
+	if !ext.ConfirmService(fmt.Sprintf("bounce [%s]", ext.Color(image, c.Yellow)), serviceName) {
 		return
 	}
 
 	cmd := deploy(serviceName, image, ext.PROJECT(), ext.REGION())
 	cmd += " --update-env-vars BOUNCED=" + time.Now().Format(time.RFC3339)
-	ext.Run(cmd)
+	ext.Mutate(cmd)
 
 	ext.Notify("bounced")
 }
@@ -381,6 +496,7 @@ var (
 
 func createCmd() {
 	serviceName := ext.SERVICE()
+	spec := loadSpec(serviceName)
 	if serviceExists(serviceName, ext.PROJECT(), ext.REGION()) {
 		ext.Die("service already exists: %s", serviceName)
 	}
@@ -388,15 +504,7 @@ func createCmd() {
 	image := *fStub
 
 	if *fStub == "" {
-		images := queryImages(true)
-
-		index, version := selectImage(images, "UNDEFINED")
-		fmt.Println(">", version)
-		delimiter := ":"
-		if strings.HasPrefix(version, "sha256") {
-			delimiter = "@"
-		}
-		image = images[index].Package + delimiter + version
+		image = pickImage("UNDEFINED")
 	} else {
 		_, _, fqn := strings.Cut(image, "/")
 		if !fqn {
@@ -404,24 +512,13 @@ func createCmd() {
 		}
 	}
 
-	if !ext.Confirm(fmt.Sprintf("deploy [%s]", ext.Color(image, c.Yellow))) {
+	if !ext.ConfirmService(fmt.Sprintf("create %s [%s]", serviceName, ext.Color(image, c.Yellow)), serviceName) {
 		return
 	}
 
-	cmd := fmt.Sprintf(""+
-		"gcloud run deploy %s --image %s --region %s --project=%s "+
-		"--allow-unauthenticated "+
-		"--port=8000 "+
-		"--min-instances=0 "+
-		"--max-instances=1 "+
-		"--memory=512Mi "+
-		"--cpu=1 "+
-		"--ingress=all "+
-		"--execution-environment=gen2 "+
-		"--update-env-vars CREATED_AT=%s",
-		serviceName, image, ext.PROJECT(), ext.REGION(), time.Now().Format(time.RFC3339))
-
-	ext.Run(cmd)
+	cmd := fmt.Sprintf("gcloud run deploy %s --image %s --region %s --project=%s %s",
+		serviceName, image, ext.REGION(), ext.PROJECT(), strings.Join(spec.createFlags(), " "))
+	ext.Mutate(cmd)
 
 	ext.Notify("new service created")
 }
@@ -430,7 +527,7 @@ func metadataCmd() {
 	images := queryImages(true)
 
 	index, version := selectImage(images, "")
-	fmt.Println(">", version)
+	fmt.Fprintln(ext.Info(), ">", version)
 	sep := ":"
 	if strings.HasPrefix(version, "sha256") {
 		sep = "@"
@@ -441,61 +538,104 @@ func metadataCmd() {
 	ext.RunJQ(cmd, ".Name, .Digest, .Architecture, .Env")
 }
 
+// ServiceSummary is what cr info reports.
+type ServiceSummary struct {
+	Service  string   `json:"service"`
+	Project  string   `json:"project"`
+	Region   string   `json:"region"`
+	Console  string   `json:"console"`
+	URLs     []string `json:"urls"`
+	Image    string   `json:"image"`
+	Registry string   `json:"registry,omitempty"`
+	Health   any      `json:"health,omitempty"`
+}
+
 func infoCmd() {
+	if len(ext.Regions()) > 1 {
+		regionsInfoCmd()
+		return
+	}
 	serviceName := ext.SERVICE()
-	service := serviceInfo(serviceName, ext.PROJECT(), ext.REGION())
-
-	fmt.Println("service", ext.Color(serviceLink(ext.PROJECT(), ext.REGION(), serviceName), c.Blue))
-
-	urls := strings.Split(service.Metadata.Annotations["run.googleapis.com/urls"], ",")
-	fmt.Println("urls", ext.Color(strings.Join(urls, ", "), c.Magenta))
+	project, region := ext.PROJECT(), ext.REGION()
+	service := serviceInfo(serviceName, project, region)
 
-	currentImage := service.Spec.Template.Spec.Containers[0].Image
-	fmt.Println("image", ext.Color(currentImage, c.Yellow))
-	if strings.Contains(currentImage, "/") {
-		// If the image is fully qualified, print it as a link.
-		fmt.Println(registryLink(currentImage))
+	summary := ServiceSummary{
+		Service: serviceName,
+		Project: project,
+		Region:  region,
+		Console: serviceLink(project, region, serviceName),
+		URLs:    strings.Split(service.Metadata.Annotations["run.googleapis.com/urls"], ","),
+		Image:   service.Spec.Template.Spec.Containers[0].Image,
+	}
+	if strings.Contains(summary.Image, "/") {
+		// If the image is fully qualified, it can be linked.
+		summary.Registry = registryLink(summary.Image)
+	}
+	if ext.Machine() {
+		summary.Health, _ = queryHealth(service)
 	}
-	healthCmd()
-}
-
-func healthCmd() {
-	service := serviceInfo(ext.SERVICE(), ext.PROJECT(), ext.REGION())
-	url := service.Status.Address.URL + "/health"
-
-	fmt.Println("\n" + ext.Color("GET ", c.Blue) + ext.Color(url, c.White))
-
-	b, err := script.Get(url).Bytes()
-	ext.Check(err)
 
-	var v interface{}
-	ext.Check(json.NewDecoder(bytes.NewReader(b)).Decode(&v))
+	ext.Output(summary, func() {
+		fmt.Println("service", ext.Color(summary.Console, c.Blue))
+		fmt.Println("urls", ext.Color(strings.Join(summary.URLs, ", "), c.Magenta))
+		fmt.Println("image", ext.Color(summary.Image, c.Yellow))
+		if summary.Registry != "" {
+			fmt.Println(summary.Registry)
+		}
+		printHealth(service)
+	})
+}
 
-	b, err = json.MarshalIndent(v, "", "  ")
-	ext.Check(err)
+// ImageVersion is an Artifact Registry image as listed by cr images.
+type ImageVersion struct {
+	Created time.Time `json:"created"`
+	Digest  string    `json:"digest"`
+	Size    int       `json:"size,omitempty"`
+	Tags    []string  `json:"tags,omitempty"`
+	Image   string    `json:"image"`
+}
 
-	fmt.Println(string(b))
+func imageVersions(images []Image) []ImageVersion {
+	versions := []ImageVersion{}
+	for _, image := range images {
+		created, err := time.Parse(time.RFC3339, image.CreateTime)
+		ext.Check(err)
+		v := ImageVersion{
+			Created: created,
+			Digest:  image.Version,
+			Tags:    image.Tags,
+			Image:   image.Package + "@" + image.Version,
+		}
+		if image.Metadata.ImageSizeBytes != "" {
+			v.Size = ext.Atoi(image.Metadata.ImageSizeBytes)
+		}
+		versions = append(versions, v)
+	}
+	return versions
 }
 
-func revisionsCmd() {
+func imagesCmd() {
 	images := queryImages(true)
-	for _, version := range textualizeVersions(images) {
-		fmt.Println(version)
-	}
+	ext.Output(imageVersions(images), func() {
+		for _, version := range textualizeVersions(images) {
+			fmt.Println(version)
+		}
+	})
 }
 
 func waitCmd() {
 	lastImage := queryImages(true)[0]
 	version := formatVersion(lastImage, 0)
-	fmt.Println(">", version)
+	fmt.Fprintln(ext.Info(), ">", version)
 
 	s := spinner.New(
 		spinner.CharSets[14], 100*time.Millisecond,
 		spinner.WithHiddenCursor(false),
 	)
 	s.Start()
+	defer s.Stop()
 	for {
-		time.Sleep(1 * time.Second)
+		ext.Check(ext.Sleep(ext.Context(), 1*time.Second))
 		image := queryImages(false)[0]
 		if lastImage.Version != image.Version {
 			s.Stop()
@@ -509,14 +649,10 @@ func waitCmd() {
 
 func initCmd() {
 	cr := ".cr"
-	if _, err := os.Create(cr); err == nil {
+	if _, err := os.Stat(cr); err == nil {
 		ext.Die(".cr already exists")
 	}
-	f, err := os.Create(cr)
-	ext.Check(err)
-	defer f.Close()
-	_, err = io.WriteString(f, strings.TrimSpace(CR)+"\n")
-	ext.Check(err)
+	ext.Check(ext.WriteFile(cr, []byte(strings.TrimSpace(CR)+"\n"), 0o644))
 }
 
 const CR = `
@@ -528,91 +664,144 @@ REGION=region
 SERVICE=service
 `
 
-func variablesCmd() {
-	serviceName := ext.SERVICE()
-	project := ext.PROJECT()
-	region := ext.REGION()
-	service := serviceInfo(serviceName, project, region)
+// Variables is what cr variables reports.
+type Variables struct {
+	Service        string      `json:"service"`
+	Console        string      `json:"console"`
+	Env            []EnvVar    `json:"env"`
+	Secrets        []SecretRef `json:"secrets"`
+	ServiceAccount string      `json:"serviceAccount,omitempty"`
+	Roles          []string    `json:"roles,omitempty"`
+}
 
-	container := service.Spec.Template.Spec.Containers[0]
+type EnvVar struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
 
-	// environment variables
-	fmt.Println(ext.Color("env", c.Blue))
-	for _, e := range container.Env {
-		if e.ValueFrom != nil {
-			continue
+// SecretRef is an environment variable backed by Secret Manager.
+type SecretRef struct {
+	Env     string `json:"env"`
+	Secret  string `json:"secret"`
+	Version string `json:"version"`
+	Link    string `json:"link"`
+	Value   string `json:"value,omitempty"`
+}
+
+// secretAliases maps the aliases used in secretKeyRef to real secret
+// names, parsed from the "run.googleapis.com/secrets" annotation in the
+// format "alias-1:projects/PROJECT/secrets/SECRET_NAME,alias-2:...".
+func secretAliases(template Template) map[string]string {
+	aliases := map[string]string{}
+	mapping := template.Metadata.Annotations["run.googleapis.com/secrets"]
+	if mapping == "" {
+		return aliases
+	}
+	for entry := range strings.SplitSeq(mapping, ",") {
+		alias, ref, _ := strings.Cut(entry, ":")
+		parts := strings.Split(ref, "/")
+		if len(parts) >= 4 {
+			aliases[alias] = parts[len(parts)-1]
 		}
-		fmt.Printf("  %s=%s\n", ext.Color(e.Name, c.Yellow), e.Value)
 	}
+	return aliases
+}
 
-	// secrets
-	// parse alias→real secret name from annotation "run.googleapis.com/secrets"
-	// format: "alias-1:projects/PROJECT/secrets/SECRET_NAME,alias-2:..."
-	secretAliases := map[string]string{}
-	if mapping := service.Spec.Template.Metadata.Annotations["run.googleapis.com/secrets"]; mapping != "" {
-		for entry := range strings.SplitSeq(mapping, ",") {
-			alias, ref, _ := strings.Cut(entry, ":")
-			// ref is "projects/PROJECT/secrets/SECRET_NAME"
-			parts := strings.Split(ref, "/")
-			if len(parts) >= 4 {
-				secretAliases[alias] = parts[len(parts)-1]
-			}
-		}
+func secretLink(project, secret string) string {
+	return fmt.Sprintf("%s/security/secret-manager/secret/%s/versions?project=%s", ext.ConsoleURL, secret, project)
+}
+
+func serviceVariables(serviceName, project, region string, service Service) Variables {
+	container := service.Spec.Template.Spec.Containers[0]
+	v := Variables{
+		Service:        serviceName,
+		Console:        fmt.Sprintf("%s/run/detail/%s/%s?project=%s", ext.ConsoleURL, region, serviceName, project),
+		Env:            []EnvVar{},
+		Secrets:        []SecretRef{},
+		ServiceAccount: service.Spec.Template.Spec.ServiceAccountName,
 	}
 
-	fmt.Println(ext.Color("\nsecrets", c.Blue))
-	hasSecrets := false
+	aliases := secretAliases(service.Spec.Template)
 	for _, e := range container.Env {
 		if e.ValueFrom == nil {
+			v.Env = append(v.Env, EnvVar{Name: e.Name, Value: e.Value})
 			continue
 		}
-		hasSecrets = true
 		alias := e.ValueFrom.SecretKeyRef.Name
-		secretVersion := e.ValueFrom.SecretKeyRef.Key
-		secretName := secretAliases[alias]
-		if secretName == "" {
-			secretName = alias
+		secret := SecretRef{
+			Env:     e.Name,
+			Secret:  aliases[alias],
+			Version: e.ValueFrom.SecretKeyRef.Key,
 		}
-		secretLink := fmt.Sprintf("%s/security/secret-manager/secret/%s/versions?project=%s", ext.ConsoleURL, secretName, project)
-		suffix := ""
+		if secret.Secret == "" {
+			secret.Secret = alias
+		}
+		secret.Link = secretLink(project, secret.Secret)
 		if *fExpand {
-			cmd := fmt.Sprintf("gcloud secrets versions access %s --secret=%s --project=%s", secretVersion, secretName, project)
-			val, err := ext.Exec(cmd, false).String()
+			cmd := fmt.Sprintf("gcloud secrets versions access %s --secret=%s --project=%s", secret.Version, secret.Secret, project)
+			val, err := ext.ExecSecret(cmd)
 			if err == nil {
-				suffix = " (" + strings.TrimSpace(val) + ")"
+				secret.Value = strings.TrimSpace(string(val))
+			}
+		}
+		v.Secrets = append(v.Secrets, secret)
+	}
+
+	if v.ServiceAccount != "" && *fExpand {
+		cmd := fmt.Sprintf(
+			`gcloud projects get-iam-policy %s `+
+				`--flatten="bindings[].members" `+
+				`--filter="bindings.members:serviceAccount:%s" `+
+				`--format="value(bindings.role)"`,
+			project, v.ServiceAccount)
+		roles, err := ext.Exec(cmd, false)
+		if err == nil {
+			for role := range strings.SplitSeq(strings.TrimSpace(string(roles)), "\n") {
+				if role != "" {
+					v.Roles = append(v.Roles, role)
+				}
 			}
 		}
-		fmt.Printf("  %s → %s%s\n", ext.Color(e.Name, c.Yellow), ext.Href(secretLink, secretName+":"+secretVersion), suffix)
 	}
-	if !hasSecrets {
+	return v
+}
+
+func variablesCmd() {
+	serviceName := ext.SERVICE()
+	project := ext.PROJECT()
+	region := ext.REGION()
+	service := serviceInfo(serviceName, project, region)
+
+	v := serviceVariables(serviceName, project, region, service)
+	ext.Output(v, func() { printVariables(v) })
+}
+
+func printVariables(v Variables) {
+	fmt.Println(ext.Color("env", c.Blue))
+	for _, e := range v.Env {
+		fmt.Printf("  %s=%s\n", ext.Color(e.Name, c.Yellow), e.Value)
+	}
+
+	fmt.Println(ext.Color("\nsecrets", c.Blue))
+	for _, s := range v.Secrets {
+		suffix := ""
+		if s.Value != "" {
+			suffix = " (" + s.Value + ")"
+		}
+		fmt.Printf("  %s → %s%s\n", ext.Color(s.Env, c.Yellow), ext.Href(s.Link, s.Secret+":"+s.Version), suffix)
+	}
+	if len(v.Secrets) == 0 {
 		fmt.Println("  (none)")
 	}
 
-	// console link
-	link := fmt.Sprintf("%s/run/detail/%s/%s?project=%s", ext.ConsoleURL, region, serviceName, project)
 	fmt.Println(ext.Color("\nconsole", c.Blue))
-	fmt.Println(" ", link)
+	fmt.Println(" ", v.Console)
 
-	// service account
-	sa := service.Spec.Template.Spec.ServiceAccountName
-	if sa != "" {
+	if v.ServiceAccount != "" {
 		fmt.Println(ext.Color("\nservice account", c.Blue))
-		fmt.Println(" ", sa)
-		if *fExpand {
-			cmd := fmt.Sprintf(
-				`gcloud projects get-iam-policy %s `+
-					`--flatten="bindings[].members" `+
-					`--filter="bindings.members:serviceAccount:%s" `+
-					`--format="value(bindings.role)"`,
-				project, sa)
-			roles, err := ext.Exec(cmd, false).String()
-			if err == nil {
-				for role := range strings.SplitSeq(strings.TrimSpace(roles), "\n") {
-					if role != "" {
-						fmt.Println("  -", role)
-					}
-				}
-			}
+		fmt.Println(" ", v.ServiceAccount)
+		for _, role := range v.Roles {
+			fmt.Println("  -", role)
 		}
 	}
 }
@@ -624,11 +813,7 @@ func terraformCmd() {
 
 	services := ext.SERVICES()
 	for i, s := range services {
-		parts := strings.SplitN(s, "-", 2)
-		if len(parts) != 2 {
-			ext.Die("service name must be in a form of 'env-name': %q", s)
-		}
-		services[i] = parts[1]
+		services[i] = terraformName(s)
 	}
 	slices.Sort(services)
 	services = slices.Compact(services)
@@ -678,14 +863,24 @@ func markedMainTF(tf string) []markedFile {
 
 var CompletionRoot = zsh.Args(
 	zsh.NewArg("h:health", "/health"),
-	zsh.NewArg("r:list", "list revisions"),
+	zsh.NewArg("r:revisions", "list revisions, their images and traffic"),
+	zsh.NewArg("images", "list images in the registry"),
 	zsh.NewArg("w:wait", "wait for new image revision"),
 	zsh.NewArg("i:info", "show service info"),
-	zsh.NewArg("d:deploy", "deploy a revision (default)"),
+	zsh.NewArg("logs", "show logs, -f to follow"),
+	zsh.NewArg("d:deploy", "deploy a revision (default), --all or --services a,b for several"),
 	zsh.NewArg("b:bounce", "bounce the service"),
-	zsh.NewArg("c:create", "create a new service"),
+	zsh.NewArg("rollback", "route traffic back to the previous revision"),
+	zsh.NewArg("traffic", "show the traffic split per revision"),
+	zsh.NewArg("c:create", "create a new service from its spec (service.toml)"),
+	zsh.NewArg("apply", "update the service where it differs from its spec"),
+	zsh.NewArg("diff", "compare two revisions, or the service and its spec"),
 	zsh.NewArg("m:metadata", "show image metadata"),
-	zsh.NewArg("t:terraform", "cross-reference terraform"),
+	zsh.NewArg("t:terraform", "cross-reference terraform, set TAG to update image tags"),
 	zsh.NewArg("v:variables", "show environment variables and secrets"),
+	zsh.NewArg("env", "set, unset, import or export environment variables"),
+	zsh.NewArg("secrets", "add, bind, pin, unpin or audit secrets"),
+	zsh.NewArg("compare", "show the configuration of two services side by side"),
 	zsh.NewArg("init", "create .cr file"),
+	zsh.NewArg("config", "show variables and where they come from"),
 )
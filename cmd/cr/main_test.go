@@ -1,7 +1,21 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"gcp/lib/ext"
 
 	"github.com/stretchr/testify/require"
 )
@@ -10,3 +24,553 @@ func TestTrimVersion(t *testing.T) {
 	v := trimVersion("abc.pkg.dev/xyz/x/abc@sha256:cf2337dbf22aab4e4530f5472dbea7845887c6e9416b453ba89d")
 	require.Equal(t, "cf2337dbf22a", v)
 }
+
+func TestQueryImages(t *testing.T) {
+	fake := ext.NewFake(ext.Reply{
+		Match: `^gcloud artifacts docker images list europe-docker.pkg.dev/p/r/app `,
+		Stdout: `[{
+			"createTime": "2025-01-02T03:04:05Z",
+			"package": "europe-docker.pkg.dev/p/r/app",
+			"tags": ["latest"],
+			"version": "sha256:cf2337dbf22aab4e4530f5472dbea7845887c6e9416b453ba89d"
+		}]`,
+	})
+	defer ext.SetRunner(ext.SetRunner(fake))
+	ext.SetVariable("REPO", "europe-docker.pkg.dev/p/r")
+	ext.SetVariable("NAME", "app")
+
+	images := queryImages(false)
+	require.Len(t, images, 1)
+	require.Equal(t, []string{"2025-01-02 03:04:05 | cf2337dbf22a |  | latest"}, textualizeVersions(images))
+}
+
+func TestVariablesReplay(t *testing.T) {
+	replayer, err := ext.NewReplayer("testdata/variables")
+	require.NoError(t, err)
+	defer ext.SetRunner(ext.SetRunner(replayer))
+	ext.SetVariable("SERVICE", "dev-api")
+	ext.SetVariable("PROJECT", "acme-dev")
+	ext.SetVariable("REGION", "europe-west1")
+
+	out := captureStdout(t, variablesCmd)
+	require.Contains(t, out, "LOG_LEVEL")
+	require.Contains(t, out, "=debug")
+	require.Contains(t, out, "dev-db-password:3")
+	require.Contains(t, out, "api@acme-dev.iam.gserviceaccount.com")
+}
+
+func captureStdout(t *testing.T, fn func()) string {
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	done := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(r)
+		done <- b
+	}()
+	fn()
+	w.Close()
+	return string(<-done)
+}
+
+func TestPreviousRevision(t *testing.T) {
+	revisions := []Revision{
+		revision("api-00004", false),
+		revision("api-00003", true),
+		revision("api-00002", false),
+		revision("api-00001", true),
+	}
+	r, ok := previousRevision(revisions, map[string]int{"api-00003": 100})
+	require.True(t, ok)
+	require.Equal(t, "api-00001", r.Name())
+
+	_, ok = previousRevision(revisions, map[string]int{"api-00001": 100})
+	require.False(t, ok)
+}
+
+func revision(name string, ready bool) Revision {
+	var r Revision
+	r.Metadata.Name = name
+	status := "False"
+	if ready {
+		status = "True"
+	}
+	r.Status.Conditions = []Condition{{Type: "Ready", Status: status}}
+	return r
+}
+
+func TestToRevisions(t *testing.T) {
+	traffic := []Traffic{
+		{RevisionName: "api-00002", Percent: 90, LatestRevision: true},
+		{RevisionName: "api-00003", Percent: 10, Tag: "canary"},
+		{RevisionName: "api-00001", Tag: "old"},
+	}
+	require.Equal(t, "api-00002=90,api-00003=10", toRevisions(traffic))
+}
+
+func TestCanaryOptions(t *testing.T) {
+	require.Equal(t, []string{promote50, promote100, abort}, canaryOptions(10, true))
+	require.Equal(t, []string{promote100, abort}, canaryOptions(60, true), "50% would lower a canary at 60%")
+	require.Equal(t, []string{abort, promote50, promote100}, canaryOptions(10, false))
+}
+
+func TestSummarizeRevisions(t *testing.T) {
+	r := revision("api-00002", true)
+	r.Spec.Containers = []Container{{Image: "europe-docker.pkg.dev/p/r/app:latest"}}
+	r.Status.ImageDigest = "europe-docker.pkg.dev/p/r/app@sha256:cf2337dbf22aab4e4530f5472dbea7845887c6e9416b453ba89d"
+	r.Metadata.Annotations = map[string]string{"autoscaling.knative.dev/maxScale": "3"}
+
+	var service Service
+	service.Status.Traffic = []Traffic{
+		{RevisionName: "api-00002", Percent: 100, LatestRevision: true},
+		{RevisionName: "api-00002", Tag: "canary"},
+	}
+	images := []Image{{
+		CreateTime: "2025-01-02T03:04:05Z",
+		Package:    "europe-docker.pkg.dev/p/r/app",
+		Tags:       []string{"latest"},
+		Version:    "sha256:cf2337dbf22aab4e4530f5472dbea7845887c6e9416b453ba89d",
+	}}
+
+	s := summarizeRevisions([]Revision{r}, service, images)
+	require.Len(t, s, 1)
+	require.Equal(t, 100, s[0].Traffic)
+	require.Equal(t, []string{"canary"}, s[0].Tags)
+	require.Equal(t, "3", s[0].MaxScale)
+	require.Equal(t, "2025-01-02 03:04:05 | cf2337dbf22a |  | latest", s[0].Version)
+}
+
+func TestHealthCheck(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ready":
+			io.WriteString(w, `{"status": "ok", "checks": [{"db": "down"}]}`)
+		case "/ping":
+			require.Equal(t, "x", r.Header.Get("X-Probe"))
+			io.WriteString(w, "pong\n")
+		case "/hang":
+			<-r.Context().Done()
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	h := HealthCheck{Path: "/ready", Method: "GET", Status: []int{200}, JSON: [][2]string{{"status", "ok"}}}
+	_, err := h.probe(t.Context(), srv.URL)
+	require.NoError(t, err)
+
+	h.JSON = [][2]string{{"checks.0.db", "up"}}
+	_, err = h.probe(t.Context(), srv.URL)
+	require.ErrorContains(t, err, `checks.0.db is "down", expected "up"`)
+
+	h.Path = "/health"
+	_, err = h.probe(t.Context(), srv.URL)
+	require.ErrorContains(t, err, "status 404")
+
+	h = HealthCheck{Path: "/ping", Method: "GET", Headers: http.Header{"X-Probe": {"x"}}, Status: []int{200}, Body: "pong"}
+	p, err := h.probe(t.Context(), srv.URL)
+	require.NoError(t, err)
+	require.Equal(t, "pong", p.Body)
+
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	h.Path = "/hang"
+	_, err = h.probe(ctx, srv.URL)
+	require.ErrorIs(t, err, context.DeadlineExceeded, "a probe stops at the deadline of its caller")
+}
+
+func TestIdentityToken(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Unix()
+	jwt := "e30." + base64.RawURLEncoding.EncodeToString(fmt.Appendf(nil, `{"exp":%d}`, exp)) + ".sig"
+	fake := ext.NewFake(
+		ext.Reply{Match: `--audiences`, ExitCode: 1, Stderr: "Invalid account type for `--audiences`"},
+		ext.Reply{Match: `^gcloud auth print-identity-token$`, Stdout: jwt + "\n"},
+	)
+	defer ext.SetRunner(ext.SetRunner(fake))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+jwt {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+
+	h := HealthCheck{Path: "/", Method: "GET", Status: []int{200}}
+	for range 2 {
+		p, err := h.probe(t.Context(), srv.URL)
+		require.NoError(t, err)
+		require.Equal(t, "ok", p.Body)
+	}
+	require.Equal(t, []string{
+		"gcloud auth print-identity-token --audiences " + srv.URL,
+		"gcloud auth print-identity-token",
+	}, fake.Lines())
+}
+
+func TestIdentityTokenReplay(t *testing.T) {
+	const audience = "https://replayed.run.app"
+	exp := time.Now().Add(time.Hour).Unix()
+	jwt := "e30." + base64.RawURLEncoding.EncodeToString(fmt.Appendf(nil, `{"exp":%d}`, exp)) + ".sig"
+	dir := t.TempDir()
+	recorder, err := ext.NewRecorder(ext.NewFake(ext.Reply{Match: `^gcloud auth print-identity-token`, Stdout: jwt}), dir)
+	require.NoError(t, err)
+	defer ext.SetRunner(ext.SetRunner(recorder))
+	token, err := identityToken(audience)
+	require.NoError(t, err)
+	require.Equal(t, jwt, token)
+	delete(tokens.byAudience, audience)
+
+	replayer, err := ext.NewReplayer(dir)
+	require.NoError(t, err)
+	ext.SetRunner(replayer)
+	require.NoError(t, flag.Set("replay", dir))
+	defer flag.Set("replay", "")
+	for range 2 {
+		token, err := identityToken(audience)
+		require.NoError(t, err, "a replayed token has no expiry to read")
+		require.Equal(t, "REDACTED", token)
+	}
+}
+
+func TestRollout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	fake := ext.NewFake(
+		ext.Reply{Match: `^gcloud run services describe api `, Stdout: `{
+			"status": {
+				"address": {"url": "` + srv.URL + `"},
+				"traffic": [{"revisionName": "api-00001", "percent": 100, "latestRevision": true}]
+			}
+		}`},
+		ext.Reply{Match: `^gcloud run deploy api `},
+		ext.Reply{Match: `^gcloud run services update-traffic api `},
+	)
+	defer ext.SetRunner(ext.SetRunner(fake))
+
+	r := &Rollout{Service: "api", Project: "acme", Region: "europe-west1"}
+	h := HealthCheck{Path: "/health", Method: "GET", Status: []int{200}, Timeout: time.Second, Interval: 100 * time.Millisecond, Verify: true}
+	rollout(context.Background(), newProgress([]*Rollout{r}), h, r, "europe-docker.pkg.dev/p/r/app:v2")
+
+	require.Equal(t, stateRolledBack, r.State)
+	require.Contains(t, r.Error, "status 503")
+	require.Contains(t, fake.Lines(), "gcloud run services update-traffic api --to-revisions api-00001=100 --region europe-west1 --project acme")
+
+	ext.SetRunner(ext.NewFake(
+		ext.Reply{Match: `^gcloud run services describe web `, Stdout: `{}`},
+		ext.Reply{Match: `^gcloud run deploy web `, Stderr: "Deploying...\nERROR: (gcloud.run.deploy) PERMISSION_DENIED: no access\n", ExitCode: 1},
+	))
+	r = &Rollout{Service: "web", Project: "acme", Region: "europe-west1"}
+	rollout(context.Background(), newProgress([]*Rollout{r}), h, r, "europe-docker.pkg.dev/p/r/app:v2")
+	require.Equal(t, stateFailed, r.State)
+	require.Equal(t, "ERROR: (gcloud.run.deploy) PERMISSION_DENIED: no access", firstLine(r.Error))
+}
+
+func TestInWaves(t *testing.T) {
+	rollouts := []*Rollout{
+		{Service: "api", Region: "europe-west1"},
+		{Service: "api", Region: "us-central1"},
+		{Service: "api", Region: "asia-east1"},
+		{Service: "web", Region: "europe-west1"},
+	}
+	regions := func(waves [][]*Rollout) [][]string {
+		out := [][]string{}
+		for _, wave := range waves {
+			names := []string{}
+			for _, r := range wave {
+				names = append(names, r.Service+"@"+r.Region)
+			}
+			out = append(out, names)
+		}
+		return out
+	}
+	require.Equal(t, [][]string{
+		{"api@europe-west1", "web@europe-west1"},
+		{"api@us-central1"},
+		{"api@asia-east1"},
+	}, regions(inWaves(rollouts, 0)))
+	require.Equal(t, [][]string{
+		{"api@europe-west1", "api@us-central1", "web@europe-west1"},
+		{"api@asia-east1"},
+	}, regions(inWaves(rollouts, 2)))
+}
+
+func TestUpdateFlags(t *testing.T) {
+	live := defaultSpec()
+	live.Env = map[string]string{"LOG_LEVEL": "debug", "OLD": "1"}
+	want := defaultSpec()
+	want.Memory = "1Gi"
+	want.Env = map[string]string{"LOG_LEVEL": "info", "ORIGINS": "a,b"}
+
+	require.Equal(t, []string{
+		"--memory=1Gi",
+		"--update-env-vars", "'^|^LOG_LEVEL=info|ORIGINS=a,b'",
+		"--remove-env-vars", "OLD",
+	}, updateFlags(live, want))
+	require.Empty(t, updateFlags(want, want))
+}
+
+func TestLiveSpec(t *testing.T) {
+	var service Service
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"metadata": {"annotations": {"run.googleapis.com/ingress": "all"}},
+		"spec": {"template": {
+			"metadata": {"annotations": {"autoscaling.knative.dev/maxScale": "1"}},
+			"spec": {"containers": [{
+				"ports": [{"containerPort": 8000}],
+				"resources": {"limits": {"cpu": "1000m", "memory": "512Mi"}}
+			}]}
+		}}
+	}`), &service))
+
+	want := defaultSpec()
+	live := liveSpec(service, Variables{}, true, want)
+	require.Empty(t, updateFlags(live, want), "a service created without an execution environment is not changed")
+
+	want.ExecutionEnvironment = "gen2"
+	live = liveSpec(service, Variables{}, true, want)
+	require.Equal(t, []string{"--execution-environment=gen2"}, updateFlags(live, want))
+}
+
+func TestChanges(t *testing.T) {
+	parse := func(s string) Template {
+		var r Revision
+		require.NoError(t, json.Unmarshal([]byte(s), &r))
+		return r.Template
+	}
+	a := parse(`{
+		"metadata": {"annotations": {
+			"autoscaling.knative.dev/maxScale": "1",
+			"run.googleapis.com/secrets": "db-pass:projects/1/secrets/db-password",
+			"serving.knative.dev/creator": "a@x"
+		}},
+		"spec": {"containers": [{
+			"image": "app:v1",
+			"ports": [{"containerPort": 8080}],
+			"resources": {"limits": {"cpu": "1000m", "memory": "512Mi"}},
+			"env": [
+				{"name": "LOG_LEVEL", "value": "debug"},
+				{"name": "DB_PASSWORD", "valueFrom": {"secretKeyRef": {"key": "3", "name": "db-pass"}}}
+			]
+		}]}
+	}`)
+	b := parse(`{
+		"metadata": {"annotations": {
+			"autoscaling.knative.dev/maxScale": "3",
+			"serving.knative.dev/creator": "b@x"
+		}},
+		"spec": {"containers": [{
+			"image": "app:v2",
+			"ports": [{"containerPort": 8080}, {"containerPort": 9090}],
+			"resources": {"limits": {"cpu": "1000m", "memory": "512Mi"}},
+			"env": [{"name": "LOG_LEVEL", "value": "debug"}]
+		}]}
+	}`)
+	require.Equal(t, []Change{
+		{Key: "image", Before: "app:v1", After: "app:v2"},
+		{Key: "port1", After: "9090"},
+		{Key: "scaling.max", Before: "1", After: "3"},
+		{Key: "secret.DB_PASSWORD", Before: "db-password:3"},
+	}, changes(flatten(a), flatten(b)))
+}
+
+func TestReadLogs(t *testing.T) {
+	fake := ext.NewFake(ext.Reply{
+		Match: `^gcloud logging read 'resource.type="cloud_run_revision" AND .*severity>=WARNING' --project acme`,
+		Stdout: `[
+			{"insertId": "2", "timestamp": "2025-01-02T03:04:06Z", "severity": "ERROR",
+			 "jsonPayload": {"message": "db down", "attempt": 3}, "trace": "projects/acme/traces/abcdef0123456789"},
+			{"insertId": "1", "timestamp": "2025-01-02T03:04:05Z", "severity": "WARNING", "textPayload": "slow\n"}
+		]`,
+	})
+	defer ext.SetRunner(ext.SetRunner(fake))
+	*fSeverity = "warning"
+	defer func() { *fSeverity = "" }()
+
+	entries := readLogs(logFilter("api", "europe-west1", time.Now()), "acme", 10, false)
+	require.Len(t, entries, 2)
+	require.Equal(t, "slow", message(entries[0]))
+	require.Contains(t, message(entries[1]), "db down")
+	require.Contains(t, message(entries[1]), "attempt=")
+	require.Equal(t, "abcdef0123456789", traceID(entries[1].Trace))
+
+	fake = ext.NewFake(ext.Reply{Match: `^gcloud logging read `, Stdout: `[
+		{"insertId": "1", "timestamp": "2025-01-02T03:04:05Z"},
+		{"insertId": "2", "timestamp": "2025-01-02T03:04:06Z"}
+	]`})
+	ext.SetRunner(fake)
+	entries = readLogs("f", "acme", 0, false)
+	require.Equal(t, "1", entries[0].InsertID, "followed entries are read oldest first")
+	require.Equal(t, []string{"gcloud logging read f --project acme --format json --order asc"}, fake.Lines())
+}
+
+func TestSecretState(t *testing.T) {
+	fake := ext.NewFake(
+		ext.Reply{Match: `describe 3 --secret db`, Stdout: `{"name":"projects/1/secrets/db/versions/3","state":"DESTROYED"}`},
+		ext.Reply{Match: `describe latest --secret db`, Stdout: `{"name":"projects/1/secrets/db/versions/4","state":"ENABLED"}`},
+		ext.Reply{Match: `--secret gone`, ExitCode: 1, Stderr: "NOT_FOUND"},
+		ext.Reply{Match: `--secret locked`, ExitCode: 1, Stderr: "ERROR: PERMISSION_DENIED"},
+		ext.Reply{Match: `versions list db`, Stdout: `[{"name":"projects/1/secrets/db/versions/4"}]`},
+	)
+	defer ext.SetRunner(ext.SetRunner(fake))
+
+	require.Equal(t, "DESTROYED", secretState("db", "3", "p"))
+	require.Equal(t, "ENABLED", secretState("db", "latest", "p"))
+	require.Equal(t, "MISSING", secretState("gone", "1", "p"))
+	require.Equal(t, "4", newestEnabledVersion("db", "p"))
+	var err error
+	func() {
+		defer ext.Catch(&err)
+		secretState("locked", "1", "p")
+	}()
+	require.Error(t, err, "a version that cannot be read is not a missing one")
+
+	ext.SetRunner(ext.NewFake(
+		ext.Reply{Match: `describe db `, Stdout: `{"name":"projects/1/secrets/db"}`},
+		ext.Reply{Match: `describe new `, Stderr: "ERROR: NOT_FOUND: Secret [new] not found", ExitCode: 1},
+		ext.Reply{Match: `describe locked `, Stderr: "ERROR: PERMISSION_DENIED", ExitCode: 1},
+	))
+	require.True(t, secretExists("db", "p"))
+	require.False(t, secretExists("new", "p"))
+	err = nil
+	func() {
+		defer ext.Catch(&err)
+		secretExists("locked", "p")
+	}()
+	require.Error(t, err, "a secret that cannot be read is not a missing one")
+}
+
+func TestCompare(t *testing.T) {
+	list := compare(
+		map[string]string{"image": "a:1", "env.MODE": "dev", "limits.cpu": "1"},
+		map[string]string{"image": "a:1", "env.MODE": "prod", "scaling.min": "2"},
+	)
+	require.Equal(t, []Comparison{
+		{Key: "env.MODE", A: "dev", B: "prod"},
+		{Key: "image", A: "a:1", B: "a:1", Same: true},
+		{Key: "limits.cpu", A: "1"},
+		{Key: "scaling.min", B: "2"},
+	}, list)
+
+	target := parseTarget("prod-project/api@us-central1")
+	require.Equal(t, Target{Service: "api", Project: "prod-project", Region: "us-central1"}, target)
+}
+
+func TestSetImageTags(t *testing.T) {
+	src := `# @mark=prod
+module "api" {
+  api_image_tag   = "v1" # deployed 2026-10-01
+  web_image_tag   = "${var.tag}"
+  other_image_tag = "v1"
+  /*
+  api_image_tag = "v0"
+  */
+  script = <<EOT
+api_image_tag = "v0"
+EOT
+}
+
+locals {
+  settings = { api_image_tag = "v1" }
+  api_image_tag="v1"
+}
+`
+	got, n, err := setImageTags("main.tf", []byte(src), map[string]string{"api": "v2", "web": "v2"})
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	want := strings.Replace(src, `"v1" # deployed`, `"v2" # deployed`, 1)
+	want = strings.Replace(want, `api_image_tag="v1"`, `api_image_tag="v2"`, 1)
+	require.Equal(t, want, string(got))
+
+	_, _, err = setImageTags("main.tf", []byte(`api_image_tag = "v1`), nil)
+	require.Error(t, err)
+
+	tag, ok := imageTag("europe-docker.pkg.dev/p/r/api:v3")
+	require.True(t, ok)
+	require.Equal(t, "v3", tag)
+	tag, _ = imageTag("localhost:5000/api")
+	require.Equal(t, "latest", tag)
+	_, ok = imageTag("europe-docker.pkg.dev/p/r/api@sha256:abc")
+	require.False(t, ok)
+
+	ext.SetVariable("SERVICE", "dev-api")
+	ext.SetVariable("PROJECT", "acme-dev")
+	ext.SetVariable("REGION", "europe-west1")
+	defer ext.SetRunner(ext.SetRunner(ext.NewFake(ext.Reply{
+		Match:  `^gcloud run services describe dev-api `,
+		Stdout: `{"spec": {"template": {"spec": {"containers": [{"image": "europe-docker.pkg.dev/p/r/api:"}]}}}}`,
+	})))
+	err = nil
+	func() {
+		defer ext.Catch(&err)
+		runningTags()
+	}()
+	require.ErrorContains(t, err, `invalid tag ""`)
+}
+
+func TestHealthVerify(t *testing.T) {
+	defer func() {
+		ext.SetVariable("HEALTH_PATH", "")
+		ext.SetVariable("HEALTH_VERIFY", "")
+	}()
+	require.False(t, healthCheck().Verify, "a service without HEALTH_PATH may have no health endpoint")
+	ext.SetVariable("HEALTH_PATH", "/ready")
+	require.True(t, healthCheck().Verify)
+	ext.SetVariable("HEALTH_VERIFY", "off")
+	require.False(t, healthCheck().Verify)
+	ext.SetVariable("HEALTH_PATH", "")
+	ext.SetVariable("HEALTH_VERIFY", "on")
+	require.True(t, healthCheck().Verify)
+}
+
+func TestHealthHeaders(t *testing.T) {
+	defer ext.SetVariable("HEALTH_HEADERS", "")
+	ext.SetVariable("HEALTH_HEADERS", "Accept: text/plain; q=0.9\nCookie: a=1; b=2\n")
+	require.Equal(t, http.Header{
+		"Accept": {"text/plain; q=0.9"},
+		"Cookie": {"a=1; b=2"},
+	}, healthCheck().Headers)
+}
+
+func TestEnvUpdate(t *testing.T) {
+	defer ext.SetRunner(ext.SetRunner(ext.NewFake(
+		ext.Reply{Match: `^gcloud run services describe api `, Stdout: `{"spec": {"template": {
+			"metadata": {"annotations": {"run.googleapis.com/secrets": "db:projects/1/secrets/db-password"}},
+			"spec": {"containers": [{"env": [
+				{"name": "LOG_LEVEL", "value": "debug"},
+				{"name": "OLD", "value": "1"},
+				{"name": "DB_PASSWORD", "valueFrom": {"secretKeyRef": {"name": "db", "key": "latest"}}}
+			]}]}
+		}}}`},
+	)))
+	v := serviceVariables("api", "acme", "europe-west1", serviceInfo("api", "acme", "europe-west1"))
+	const update = "gcloud run services update api --region europe-west1 --project acme "
+
+	list, cmd := envUpdate("api", "acme", "europe-west1", v, "set", []string{"LOG_LEVEL=info", "ORIGINS=a,b"})
+	require.Len(t, list, 2)
+	require.Equal(t, update+"--update-env-vars '^|^LOG_LEVEL=info|ORIGINS=a,b'", cmd)
+
+	list, cmd = envUpdate("api", "acme", "europe-west1", v, "unset", []string{"OLD", "DB_PASSWORD"})
+	require.Equal(t, []Change{{Key: "OLD", Before: "1"}, {Key: "DB_PASSWORD", Before: "db-password:latest"}}, list)
+	require.Equal(t, update+"--remove-env-vars OLD --remove-secrets DB_PASSWORD", cmd)
+
+	file := filepath.Join(t.TempDir(), ".env")
+	os.WriteFile(file, []byte("LOG_LEVEL=debug\nNEW=x\n"), 0o644)
+	_, cmd = envUpdate("api", "acme", "europe-west1", v, "import", []string{file})
+	require.Equal(t, update+"--update-env-vars 'NEW=x'", cmd)
+
+	var err error
+	func() {
+		defer ext.Catch(&err)
+		envUpdate("api", "acme", "europe-west1", v, "set", []string{"DB_PASSWORD=hunter2"})
+	}()
+	require.ErrorContains(t, err, "DB_PASSWORD is set from secret db-password:latest")
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"text/tabwriter"
+
+	"gcp/lib/ext"
+
+	c "github.com/logrusorgru/aurora/v4"
+)
+
+// RegionSummary is one region of a service as shown by cr info.
+type RegionSummary struct {
+	Region string `json:"region"`
+	URL    string `json:"url,omitempty"`
+	Image  string `json:"image,omitempty"`
+	Health any    `json:"health,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// regionsInfoCmd shows a service running in several regions side by side.
+func regionsInfoCmd() {
+	serviceName := ext.SERVICE()
+	project := ext.PROJECT()
+	regions := ext.Regions()
+	h := healthCheck()
+
+	summaries := make([]RegionSummary, len(regions))
+	var wg sync.WaitGroup
+	for i, region := range regions {
+		wg.Go(func() { summaries[i] = regionSummary(h, serviceName, project, region) })
+	}
+	wg.Wait()
+
+	ext.Output(summaries, func() {
+		fmt.Println("service", ext.Color(serviceName, c.Yellow), "project", ext.Color(project, c.Yellow))
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "REGION\tURL\tIMAGE\tHEALTH")
+		images := map[string]bool{}
+		for _, s := range summaries {
+			images[s.Image] = true
+		}
+		for _, s := range summaries {
+			health := "ok"
+			if s.Error != "" {
+				health = firstLine(s.Error)
+			}
+			image := s.Image
+			if len(images) > 1 {
+				// Regions running different images stand out.
+				image = c.Yellow(image).String()
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", s.Region, s.URL, image, health)
+		}
+		w.Flush()
+		for _, s := range summaries {
+			if s.Health != nil {
+				b, err := json.Marshal(s.Health)
+				ext.Check(err)
+				fmt.Println(ext.Color(s.Region, c.Blue), string(b))
+			}
+		}
+	})
+}
+
+// regionSummary describes and probes a service in one region. It runs
+// side by side with the other regions, so any failure goes to Error.
+func regionSummary(h HealthCheck, serviceName, project, region string) (s RegionSummary) {
+	s.Region = region
+	var err error
+	defer func() {
+		if err != nil {
+			s.Error = err.Error()
+		}
+	}()
+	defer ext.Catch(&err)
+
+	service, err := describeService(ext.Context(), serviceName, project, region)
+	if err != nil {
+		return s
+	}
+	s.URL = service.Status.Address.URL
+	s.Image = service.Spec.Template.Spec.Containers[0].Image
+	p, err := h.probe(ext.Context(), s.URL)
+	s.Health = p.Body
+	return s
+}
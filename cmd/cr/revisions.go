@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gcp/lib/ext"
+
+	c "github.com/logrusorgru/aurora/v4"
+)
+
+// RevisionSummary is a Cloud Run revision as listed by cr revisions.
+type RevisionSummary struct {
+	Name     string    `json:"name"`
+	Created  time.Time `json:"created"`
+	Image    string    `json:"image"`
+	Version  string    `json:"version,omitempty"`
+	Traffic  int       `json:"traffic"`
+	Tags     []string  `json:"tags,omitempty"`
+	Ready    bool      `json:"ready"`
+	MinScale string    `json:"minScale,omitempty"`
+	MaxScale string    `json:"maxScale,omitempty"`
+}
+
+// summarizeRevisions joins revisions with the traffic split of the
+// service and, when images are given, with the image each one runs.
+func summarizeRevisions(revisions []Revision, service Service, images []Image) []RevisionSummary {
+	tags := map[string][]string{}
+	for _, t := range service.Status.Traffic {
+		if t.Tag != "" {
+			tags[t.RevisionName] = append(tags[t.RevisionName], t.Tag)
+		}
+	}
+	percent := trafficPercent(service)
+	sizeWidth := maxSizeWidth(images)
+
+	summaries := []RevisionSummary{}
+	for _, r := range revisions {
+		s := RevisionSummary{
+			Name:     r.Name(),
+			Created:  r.Metadata.CreationTimestamp,
+			Image:    r.Image(),
+			Traffic:  percent[r.Name()],
+			Tags:     tags[r.Name()],
+			Ready:    r.Ready(),
+			MinScale: r.Metadata.Annotations["autoscaling.knative.dev/minScale"],
+			MaxScale: r.Metadata.Annotations["autoscaling.knative.dev/maxScale"],
+		}
+		_, digest, _ := strings.Cut(r.Status.ImageDigest, "@")
+		for _, image := range images {
+			if digest != "" && image.Version == digest {
+				s.Version = formatVersion(image, sizeWidth)
+				break
+			}
+		}
+		summaries = append(summaries, s)
+	}
+	return summaries
+}
+
+func printRevisions(summaries []RevisionSummary) {
+	for _, s := range summaries {
+		version := s.Version
+		if version == "" {
+			version = s.Image
+		}
+		scale := fmt.Sprintf("%s..%s", s.MinScale, s.MaxScale)
+		if scale == ".." {
+			scale = "-"
+		}
+		tags := "-"
+		if len(s.Tags) > 0 {
+			tags = "#" + strings.Join(s.Tags, " #")
+		}
+		line := fmt.Sprintf("%s | %s | %3d%% | %s | %s | %s",
+			s.Name, s.Created.Local().Format(time.DateTime), s.Traffic, tags, scale, version)
+		switch {
+		case !s.Ready:
+			fmt.Println(ext.Color(line+" | not ready", c.Red))
+		case s.Traffic > 0:
+			fmt.Println(ext.Color(line, c.Green))
+		default:
+			fmt.Println(line)
+		}
+	}
+}
+
+func revisionsCmd() {
+	serviceName := ext.SERVICE()
+	project := ext.PROJECT()
+	region := ext.REGION()
+
+	service := serviceInfo(serviceName, project, region)
+	revisions := queryRevisions(serviceName, project, region)
+	summaries := summarizeRevisions(revisions, service, queryImages(true))
+	ext.Output(summaries, func() { printRevisions(summaries) })
+}
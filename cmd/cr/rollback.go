@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"gcp/lib/ext"
+
+	c "github.com/logrusorgru/aurora/v4"
+)
+
+// Revision is a Cloud Run revision as listed by gcloud run revisions list.
+type Revision struct {
+	Template
+	Status struct {
+		Conditions  []Condition `json:"conditions"`
+		ImageDigest string      `json:"imageDigest"`
+	} `json:"status"`
+}
+
+type Condition struct {
+	Type   string `json:"type"`
+	Status string `json:"status"`
+}
+
+func (r Revision) Name() string {
+	return r.Metadata.Name
+}
+
+func (r Revision) Image() string {
+	if len(r.Spec.Containers) == 0 {
+		return ""
+	}
+	return r.Spec.Containers[0].Image
+}
+
+func (r Revision) Ready() bool {
+	for _, condition := range r.Status.Conditions {
+		if condition.Type == "Ready" {
+			return condition.Status == "True"
+		}
+	}
+	return false
+}
+
+// queryRevisions returns the revisions of a service, newest first.
+func queryRevisions(service, project, region string) []Revision {
+	cmd := fmt.Sprintf(
+		"gcloud run revisions list --service %s --region %s --project %s --format json",
+		service, region, project)
+	b := ext.Capture(cmd, true)
+	revisions := []Revision{}
+	ext.Check(json.Unmarshal(b, &revisions))
+	sort.SliceStable(revisions, func(i, j int) bool {
+		return revisions[i].Metadata.CreationTimestamp.After(revisions[j].Metadata.CreationTimestamp)
+	})
+	return revisions
+}
+
+// trafficPercent returns the share of traffic each revision receives.
+func trafficPercent(service Service) map[string]int {
+	percent := map[string]int{}
+	for _, t := range service.Status.Traffic {
+		percent[t.RevisionName] += t.Percent
+	}
+	return percent
+}
+
+// previousRevision picks the newest ready revision older than the newest
+// one receiving traffic.
+func previousRevision(revisions []Revision, percent map[string]int) (Revision, bool) {
+	serving := false
+	for _, r := range revisions {
+		if percent[r.Name()] > 0 {
+			serving = true
+			continue
+		}
+		if serving && r.Ready() {
+			return r, true
+		}
+	}
+	return Revision{}, false
+}
+
+func rollbackCmd() {
+	serviceName := ext.SERVICE()
+	project := ext.PROJECT()
+	region := ext.REGION()
+
+	service := serviceInfo(serviceName, project, region)
+	revisions := queryRevisions(serviceName, project, region)
+	percent := trafficPercent(service)
+	printRevisions(summarizeRevisions(revisions, service, nil))
+
+	target, ok := previousRevision(revisions, percent)
+	if !ok {
+		ext.Die("no earlier ready revision of %s to roll back to", serviceName)
+	}
+	message := fmt.Sprintf("roll back to [%s]", ext.Color(target.Name(), c.Yellow))
+	if !ext.ConfirmService(message, serviceName) {
+		return
+	}
+
+	ext.Mutate(fmt.Sprintf(
+		"gcloud run services update-traffic %s --to-revisions %s=100 --region %s --project %s",
+		serviceName, target.Name(), region, project))
+	if ext.DryRun() {
+		return
+	}
+	healthCmd()
+
+	ext.Notify("rolled back")
+}
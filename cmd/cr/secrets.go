@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"gcp/lib/ext"
+
+	"github.com/AlecAivazis/survey/v2"
+	c "github.com/logrusorgru/aurora/v4"
+	"golang.org/x/term"
+)
+
+// PinnedSecret is a secret version a service refers to, and its state.
+type PinnedSecret struct {
+	Service string `json:"service"`
+	Region  string `json:"region"`
+	Env     string `json:"env"`
+	Secret  string `json:"secret"`
+	Version string `json:"version"`
+	State   string `json:"state"`
+}
+
+// secretsCmd manages the secrets of the service. Values are only shown
+// with -x.
+//
+//	secrets                      list the secrets of the service
+//	secrets add SECRET [FILE]    add a version from FILE, or stdin
+//	secrets bind TARGET SECRET   expose SECRET[:VERSION] as an env var, or a file if TARGET is a path
+//	secrets pin ENV [VERSION]    pin ENV to VERSION, by default the newest enabled one
+//	secrets unpin ENV            make ENV follow latest
+//	secrets audit                report pinned versions that are disabled or destroyed
+func secretsCmd(args []string) {
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+	switch sub, args := args[0], args[1:]; sub {
+	case "list":
+		listSecrets()
+	case "add":
+		if len(args) < 1 || len(args) > 2 {
+			ext.Die("secrets add takes SECRET [FILE]")
+		}
+		file := "-"
+		if len(args) == 2 {
+			file = args[1]
+		}
+		addSecretVersion(args[0], file)
+	case "bind":
+		if len(args) != 2 {
+			ext.Die("secrets bind takes TARGET SECRET[:VERSION]")
+		}
+		bindSecret(args[0], args[1])
+	case "pin":
+		if len(args) < 1 || len(args) > 2 {
+			ext.Die("secrets pin takes ENV [VERSION]")
+		}
+		version := ""
+		if len(args) == 2 {
+			version = args[1]
+		}
+		pinSecret(args[0], version)
+	case "unpin":
+		if len(args) != 1 {
+			ext.Die("secrets unpin takes ENV")
+		}
+		pinSecret(args[0], "latest")
+	case "audit":
+		auditSecrets()
+	default:
+		ext.Die("unknown secrets command: %s", sub)
+	}
+}
+
+func listSecrets() {
+	serviceName := ext.SERVICE()
+	project := ext.PROJECT()
+	region := ext.REGION()
+	v := serviceVariables(serviceName, project, region, serviceInfo(serviceName, project, region))
+
+	ext.Output(v.Secrets, func() {
+		for _, s := range v.Secrets {
+			value := c.Gray(12, "••••••").String()
+			if s.Value != "" {
+				value = s.Value
+			}
+			fmt.Printf("%s → %s %s\n", ext.Color(s.Env, c.Yellow), ext.Href(s.Link, s.Secret+":"+s.Version), value)
+		}
+		if len(v.Secrets) == 0 {
+			fmt.Println("(none)")
+		}
+	})
+}
+
+// readSecret reads a value from file, or from stdin if file is "-",
+// asking for it without echo when stdin is a terminal.
+func readSecret(file string) []byte {
+	if file != "-" {
+		b, err := os.ReadFile(file)
+		ext.Check(err)
+		return b
+	}
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		var value string
+		err := survey.AskOne(&survey.Password{Message: "value"}, &value, survey.WithValidator(survey.Required))
+		ext.Check(err)
+		return []byte(value)
+	}
+	b, err := io.ReadAll(os.Stdin)
+	ext.Check(err)
+	return b
+}
+
+func addSecretVersion(secret, file string) {
+	project := ext.PROJECT()
+	data := readSecret(file)
+
+	cmd := fmt.Sprintf("gcloud secrets versions add %s --data-file=- --project %s", secret, project)
+	message := fmt.Sprintf("add a version to [%s] (%d bytes)", ext.Color(secret, c.Yellow), len(data))
+	if !secretExists(secret, project) {
+		cmd = fmt.Sprintf("gcloud secrets create %s --replication-policy=automatic --data-file=- --project %s", secret, project)
+		message = fmt.Sprintf("create secret [%s] (%d bytes)", ext.Color(secret, c.Yellow), len(data))
+	}
+	// Services following latest get the new version on their next
+	// revision, so this is confirmed like a change to a service.
+	if !ext.ConfirmService(message, secret) {
+		return
+	}
+	ext.MutateInput(cmd, data)
+
+	ext.Notify("secret version added")
+}
+
+// secretExists reports whether secret exists, failing on any error other
+// than it not being found.
+func secretExists(secret, project string) bool {
+	_, err := ext.Exec(fmt.Sprintf("gcloud secrets describe %s --project %s --format json", secret, project), true)
+	var cmd *ext.CommandError
+	if errors.As(err, &cmd) && strings.Contains(cmd.Stderr, "NOT_FOUND") {
+		return false
+	}
+	ext.Check(err)
+	return true
+}
+
+// bindSecret exposes a secret to the service. A target starting with /
+// is a file the secret is mounted as, anything else an env var.
+func bindSecret(target, secret string) {
+	serviceName := ext.SERVICE()
+	project := ext.PROJECT()
+	region := ext.REGION()
+	if !strings.Contains(secret, ":") {
+		secret += ":latest"
+	}
+	name, _, _ := strings.Cut(secret, ":")
+
+	service := serviceInfo(serviceName, project, region)
+	message := fmt.Sprintf("bind [%s] to %s", ext.Color(secret, c.Yellow), ext.Color(target, c.Yellow))
+	if !ext.ConfirmService(message, serviceName) {
+		return
+	}
+	if sa := service.Spec.Template.Spec.ServiceAccountName; sa != "" {
+		ext.Mutate(fmt.Sprintf(
+			"gcloud secrets add-iam-policy-binding %s --member serviceAccount:%s --role roles/secretmanager.secretAccessor --project %s",
+			name, sa, project))
+	}
+	updateSecrets(serviceName, project, region, target+"="+secret)
+
+	ext.Notify("secret bound")
+}
+
+func pinSecret(env, version string) {
+	serviceName := ext.SERVICE()
+	project := ext.PROJECT()
+	region := ext.REGION()
+	v := serviceVariables(serviceName, project, region, serviceInfo(serviceName, project, region))
+
+	var ref *SecretRef
+	for i := range v.Secrets {
+		if v.Secrets[i].Env == env {
+			ref = &v.Secrets[i]
+		}
+	}
+	if ref == nil {
+		ext.Die("%s is not a secret of %s", env, serviceName)
+	}
+	if version == "" {
+		version = newestEnabledVersion(ref.Secret, project)
+	}
+	if ref.Version == version {
+		fmt.Println(c.Gray(12, fmt.Sprintf("%s is already at %s:%s", env, ref.Secret, version)))
+		return
+	}
+
+	message := fmt.Sprintf("%s from %s:%s to [%s]", env, ref.Secret, ref.Version, ext.Color(version, c.Yellow))
+	if !ext.ConfirmService(message, serviceName) {
+		return
+	}
+	updateSecrets(serviceName, project, region, fmt.Sprintf("%s=%s:%s", env, ref.Secret, version))
+
+	ext.Notify("secret pinned")
+}
+
+func newestEnabledVersion(secret, project string) string {
+	cmd := fmt.Sprintf(
+		`gcloud secrets versions list %s --project %s --filter state=enabled --sort-by ~createTime --limit 1 --format json`,
+		secret, project)
+	var versions []struct {
+		Name string `json:"name"`
+	}
+	ext.Check(json.Unmarshal(ext.Capture(cmd, true), &versions))
+	if len(versions) == 0 {
+		ext.Die("%s has no enabled versions", secret)
+	}
+	return path.Base(versions[0].Name)
+}
+
+func updateSecrets(service, project, region, secrets string) {
+	ext.Mutate(fmt.Sprintf("gcloud run services update %s --region %s --project %s --update-secrets %s",
+		service, region, project, quote(secrets)))
+}
+
+// auditSecrets checks every configured service in every region for
+// secret versions that can no longer be read.
+func auditSecrets() {
+	pins := []PinnedSecret{}
+	for _, serviceName := range ext.SERVICES() {
+		project := ext.ProjectFor(serviceName)
+		for _, region := range ext.RegionsFor(serviceName) {
+			service, err := describeService(ext.Context(), serviceName, project, region)
+			ext.Check(err, serviceName+" in "+region)
+			for _, s := range serviceVariables(serviceName, project, region, service).Secrets {
+				pins = append(pins, PinnedSecret{
+					Service: serviceName,
+					Region:  region,
+					Env:     s.Env,
+					Secret:  s.Secret,
+					Version: s.Version,
+					State:   secretState(s.Secret, s.Version, project),
+				})
+			}
+		}
+	}
+
+	broken := 0
+	for _, p := range pins {
+		if p.State != "ENABLED" {
+			broken++
+		}
+	}
+	ext.Output(pins, func() {
+		for _, p := range pins {
+			line := fmt.Sprintf("%s/%s %s → %s:%s %s", p.Service, p.Region, p.Env, p.Secret, p.Version, p.State)
+			if p.State != "ENABLED" {
+				line = ext.Color(line, c.Red)
+			}
+			fmt.Println(line)
+		}
+	})
+	if broken > 0 {
+		ext.Fail(fmt.Errorf("%d secret versions in use are not enabled", broken))
+	}
+}
+
+// secretState returns ENABLED, DISABLED or DESTROYED, or MISSING if the
+// version is not found, failing on any other error.
+func secretState(secret, version, project string) string {
+	cmd := fmt.Sprintf("gcloud secrets versions describe %s --secret %s --project %s --format json", version, secret, project)
+	b, err := ext.Exec(cmd, false)
+	var cmdErr *ext.CommandError
+	if errors.As(err, &cmdErr) && strings.Contains(cmdErr.Stderr, "NOT_FOUND") {
+		return "MISSING"
+	}
+	ext.Check(err)
+	var v struct {
+		State string `json:"state"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return "UNKNOWN"
+	}
+	return v.State
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gcp/lib/ext"
+
+	"github.com/BurntSushi/toml"
+	c "github.com/logrusorgru/aurora/v4"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// specVersion is the version of the spec file format this cr reads.
+const specVersion = 1
+
+// Spec is the shape of a service, kept in service.toml next to .cr, or in
+// <service>.toml, or wherever SPEC points. Fields left out keep the
+// defaults cr create always used. Env, secrets and labels are only
+// managed when their table is present; secrets map a variable to
+// "secret:version". The execution environment is only managed when it is
+// set, as Cloud Run leaves it out of services created without one.
+type Spec struct {
+	Version              int               `toml:"version" json:"version"`
+	Port                 int               `toml:"port" json:"port"`
+	CPU                  string            `toml:"cpu" json:"cpu"`
+	Memory               string            `toml:"memory" json:"memory"`
+	Concurrency          int               `toml:"concurrency,omitempty" json:"concurrency,omitempty"`
+	MinInstances         int               `toml:"min_instances" json:"minInstances"`
+	MaxInstances         int               `toml:"max_instances" json:"maxInstances"`
+	Ingress              string            `toml:"ingress" json:"ingress"`
+	Auth                 string            `toml:"auth" json:"auth"`
+	ServiceAccount       string            `toml:"service_account,omitempty" json:"serviceAccount,omitempty"`
+	VPCConnector         string            `toml:"vpc_connector,omitempty" json:"vpcConnector,omitempty"`
+	ExecutionEnvironment string            `toml:"execution_environment,omitempty" json:"executionEnvironment,omitempty"`
+	Env                  map[string]string `toml:"env,omitempty" json:"env,omitempty"`
+	Secrets              map[string]string `toml:"secrets,omitempty" json:"secrets,omitempty"`
+	Labels               map[string]string `toml:"labels,omitempty" json:"labels,omitempty"`
+}
+
+const (
+	authPublic  = "public"
+	authPrivate = "private"
+)
+
+// defaultExecutionEnvironment is what cr create uses when the spec does
+// not name one.
+const defaultExecutionEnvironment = "gen2"
+
+func defaultSpec() Spec {
+	return Spec{
+		Version:      specVersion,
+		Port:         8000,
+		CPU:          "1",
+		Memory:       "512Mi",
+		MinInstances: 0,
+		MaxInstances: 1,
+		Ingress:      "all",
+		Auth:         authPublic,
+	}
+}
+
+// crEnv are variables cr sets itself, which specs leave alone.
+var crEnv = []string{"CREATED_AT", "BOUNCED"}
+
+func specFile(service string) string {
+	if file, err := ext.Lookup("SPEC"); err == nil {
+		return file
+	}
+	if _, err := os.Stat(service + ".toml"); err == nil {
+		return service + ".toml"
+	}
+	return "service.toml"
+}
+
+// loadSpec reads the spec of a service, or returns the defaults if there
+// is no spec file.
+func loadSpec(service string) Spec {
+	spec := defaultSpec()
+	file := specFile(service)
+	content, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		fmt.Println("spec", c.Gray(12, "defaults, no "+file))
+		return spec
+	}
+	ext.Check(err)
+
+	spec.Version = 0
+	_, err = toml.Decode(string(content), &spec)
+	ext.Check(err, file)
+	if spec.Version != specVersion {
+		ext.Die("%s: unsupported spec version %d, expected version = %d", file, spec.Version, specVersion)
+	}
+	if spec.Auth != authPublic && spec.Auth != authPrivate {
+		ext.Die("%s: auth is %q, expected %s or %s", file, spec.Auth, authPublic, authPrivate)
+	}
+	fmt.Println("spec", ext.Color(file, c.White))
+	return spec
+}
+
+// createFlags are the gcloud run deploy flags creating a service.
+func (s Spec) createFlags() []string {
+	flags := []string{
+		fmt.Sprintf("--port=%d", s.Port),
+		fmt.Sprintf("--min-instances=%d", s.MinInstances),
+		fmt.Sprintf("--max-instances=%d", s.MaxInstances),
+		"--memory=" + s.Memory,
+		"--cpu=" + s.CPU,
+		"--ingress=" + s.Ingress,
+		"--execution-environment=" + cmp.Or(s.ExecutionEnvironment, defaultExecutionEnvironment),
+	}
+	if s.Auth == authPublic {
+		flags = append(flags, "--allow-unauthenticated")
+	} else {
+		flags = append(flags, "--no-allow-unauthenticated")
+	}
+	if s.Concurrency > 0 {
+		flags = append(flags, fmt.Sprintf("--concurrency=%d", s.Concurrency))
+	}
+	if s.ServiceAccount != "" {
+		flags = append(flags, "--service-account="+s.ServiceAccount)
+	}
+	if s.VPCConnector != "" {
+		flags = append(flags, "--vpc-connector="+s.VPCConnector)
+	}
+	env := map[string]string{"CREATED_AT": time.Now().Format(time.RFC3339)}
+	maps.Copy(env, s.Env)
+	flags = append(flags, "--set-env-vars", gcloudDict(env))
+	if len(s.Secrets) > 0 {
+		flags = append(flags, "--set-secrets", gcloudDict(s.Secrets))
+	}
+	if len(s.Labels) > 0 {
+		flags = append(flags, "--labels", gcloudDict(s.Labels))
+	}
+	return flags
+}
+
+// liveSpec describes a running service the way a spec file would. Only
+// the tables managed by managed are filled in.
+func liveSpec(service Service, vars Variables, public bool, managed Spec) Spec {
+	template := service.Spec.Template
+	container := template.Spec.Containers[0]
+	s := Spec{
+		Version:              specVersion,
+		CPU:                  cpu(container.Resources.Limits["cpu"]),
+		Memory:               container.Resources.Limits["memory"],
+		Concurrency:          template.Spec.ContainerConcurrency,
+		MinInstances:         atoi(template.Metadata.Annotations["autoscaling.knative.dev/minScale"]),
+		MaxInstances:         atoi(template.Metadata.Annotations["autoscaling.knative.dev/maxScale"]),
+		Ingress:              service.Metadata.Annotations["run.googleapis.com/ingress"],
+		Auth:                 authPrivate,
+		ServiceAccount:       template.Spec.ServiceAccountName,
+		VPCConnector:         template.Metadata.Annotations["run.googleapis.com/vpc-access-connector"],
+		ExecutionEnvironment: template.Metadata.Annotations["run.googleapis.com/execution-environment"],
+	}
+	if len(container.Ports) > 0 {
+		s.Port = container.Ports[0].ContainerPort
+	}
+	if public {
+		s.Auth = authPublic
+	}
+	if managed.Concurrency == 0 {
+		s.Concurrency = 0
+	}
+	if managed.ServiceAccount == "" {
+		s.ServiceAccount = ""
+	}
+	if managed.ExecutionEnvironment == "" {
+		s.ExecutionEnvironment = ""
+	}
+	if managed.Env != nil {
+		s.Env = map[string]string{}
+		for _, e := range vars.Env {
+			if !slices.Contains(crEnv, e.Name) {
+				s.Env[e.Name] = e.Value
+			}
+		}
+	}
+	if managed.Secrets != nil {
+		s.Secrets = map[string]string{}
+		for _, secret := range vars.Secrets {
+			s.Secrets[secret.Env] = secret.Secret + ":" + secret.Version
+		}
+	}
+	if managed.Labels != nil {
+		s.Labels = map[string]string{}
+		for k, v := range service.Metadata.Labels {
+			// Labels like cloud.googleapis.com/location are set by Cloud Run.
+			if !strings.Contains(k, "/") {
+				s.Labels[k] = v
+			}
+		}
+	}
+	return s
+}
+
+func cpu(v string) string {
+	if m, ok := strings.CutSuffix(v, "m"); ok {
+		if n, err := strconv.Atoi(m); err == nil && n%1000 == 0 {
+			return strconv.Itoa(n / 1000)
+		}
+	}
+	return v
+}
+
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+// updateFlags are the gcloud run services update flags turning the live
+// spec into the wanted one. Auth is not among them, it is IAM.
+func updateFlags(live, want Spec) []string {
+	flags := []string{}
+	flag := func(changed bool, name string, value any) {
+		if changed {
+			flags = append(flags, fmt.Sprintf("--%s=%v", name, value))
+		}
+	}
+	flag(live.Port != want.Port, "port", want.Port)
+	flag(live.CPU != want.CPU, "cpu", want.CPU)
+	flag(live.Memory != want.Memory, "memory", want.Memory)
+	flag(live.Concurrency != want.Concurrency, "concurrency", want.Concurrency)
+	flag(live.MinInstances != want.MinInstances, "min-instances", want.MinInstances)
+	flag(live.MaxInstances != want.MaxInstances, "max-instances", want.MaxInstances)
+	flag(live.Ingress != want.Ingress, "ingress", want.Ingress)
+	flag(live.ServiceAccount != want.ServiceAccount, "service-account", want.ServiceAccount)
+	flag(live.ExecutionEnvironment != want.ExecutionEnvironment, "execution-environment", want.ExecutionEnvironment)
+	if live.VPCConnector != want.VPCConnector {
+		if want.VPCConnector == "" {
+			flags = append(flags, "--clear-vpc-connector")
+		} else {
+			flags = append(flags, "--vpc-connector="+want.VPCConnector)
+		}
+	}
+	flags = append(flags, dictFlags("env-vars", live.Env, want.Env)...)
+	flags = append(flags, dictFlags("secrets", live.Secrets, want.Secrets)...)
+	flags = append(flags, dictFlags("labels", live.Labels, want.Labels)...)
+	return flags
+}
+
+// dictFlags returns --update-NAME and --remove-NAME for the keys that
+// changed between two maps.
+func dictFlags(name string, live, want map[string]string) []string {
+	update := map[string]string{}
+	for k, v := range want {
+		if lv, ok := live[k]; !ok || lv != v {
+			update[k] = v
+		}
+	}
+	remove := []string{}
+	for k := range live {
+		if _, ok := want[k]; !ok {
+			remove = append(remove, k)
+		}
+	}
+	sort.Strings(remove)
+
+	flags := []string{}
+	if len(update) > 0 {
+		flags = append(flags, "--update-"+name, gcloudDict(update))
+	}
+	if len(remove) > 0 {
+		flags = append(flags, "--remove-"+name, quote(strings.Join(remove, ",")))
+	}
+	return flags
+}
+
+// gcloudDict formats a map for flags like --update-env-vars, switching to
+// gcloud's ^DELIM^ syntax when a value contains a comma, and quoting it
+// for the shell.
+func gcloudDict(m map[string]string) string {
+	pairs := []string{}
+	for _, k := range slices.Sorted(maps.Keys(m)) {
+		pairs = append(pairs, k+"="+m[k])
+	}
+	joined := strings.Join(pairs, ",")
+	if strings.Count(joined, ",") != len(pairs)-1 {
+		delimiter := "|"
+		for _, d := range []string{"|", "@", ";", "~", "#"} {
+			if !strings.Contains(joined, d) {
+				delimiter = d
+				break
+			}
+		}
+		joined = "^" + delimiter + "^" + strings.Join(pairs, delimiter)
+	}
+	return quote(joined)
+}
+
+func quote(s string) string {
+	q, err := syntax.Quote(s, syntax.LangBash)
+	ext.Check(err)
+	return q
+}
+
+// publicService reports whether allUsers may invoke the service.
+func publicService(service, project, region string) bool {
+	cmd := fmt.Sprintf("gcloud run services get-iam-policy %s --region %s --project %s --format json", service, region, project)
+	var policy struct {
+		Bindings []struct {
+			Role    string   `json:"role"`
+			Members []string `json:"members"`
+		} `json:"bindings"`
+	}
+	ext.Check(json.Unmarshal(ext.Capture(cmd, true), &policy))
+	for _, b := range policy.Bindings {
+		if b.Role == "roles/run.invoker" && slices.Contains(b.Members, "allUsers") {
+			return true
+		}
+	}
+	return false
+}
+
+func renderSpec(s Spec) string {
+	var b bytes.Buffer
+	ext.Check(toml.NewEncoder(&b).Encode(s))
+	return b.String()
+}
+
+// applyCmd updates the service where it differs from its spec.
+func applyCmd() {
+	serviceName := ext.SERVICE()
+	project := ext.PROJECT()
+	region := ext.REGION()
+
+	want := loadSpec(serviceName)
+	service := serviceInfo(serviceName, project, region)
+	vars := serviceVariables(serviceName, project, region, service)
+	live := liveSpec(service, vars, publicService(serviceName, project, region), want)
+
+	flags := updateFlags(live, want)
+	if len(flags) == 0 && live.Auth == want.Auth {
+		fmt.Println(ext.Color("up to date", c.Green))
+		return
+	}
+	fmt.Print(ext.Diff(serviceName, renderSpec(live), renderSpec(want)))
+	if !ext.ConfirmService(fmt.Sprintf("apply to [%s]", ext.Color(serviceName, c.Yellow)), serviceName) {
+		return
+	}
+
+	if len(flags) > 0 {
+		ext.Mutate(fmt.Sprintf("gcloud run services update %s --region %s --project %s %s",
+			serviceName, region, project, strings.Join(flags, " ")))
+	}
+	if live.Auth != want.Auth {
+		binding := "add-iam-policy-binding"
+		if want.Auth == authPrivate {
+			binding = "remove-iam-policy-binding"
+		}
+		ext.Mutate(fmt.Sprintf("gcloud run services %s %s --region %s --project %s --member=allUsers --role=roles/run.invoker",
+			binding, serviceName, region, project))
+	}
+
+	ext.Notify("applied")
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"gcp/lib/ext"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	c "github.com/logrusorgru/aurora/v4"
+	"github.com/zclconf/go-cty/cty"
+)
+
+var (
+	fFromRunning = flag.Bool("from-running", false, "with terraform set, use the tags the services run")
+	fBranch      = flag.String("branch", "", "with terraform set, commit the change on a new git `branch`")
+)
+
+var dockerTag = regexp.MustCompile(`^\w[\w.-]{0,127}$`)
+
+// terraformName is the name of a service in terraform: dev-api is api.
+func terraformName(service string) string {
+	parts := strings.SplitN(service, "-", 2)
+	if len(parts) != 2 {
+		ext.Die("service name must be in a form of 'env-name': %q", service)
+	}
+	return parts[1]
+}
+
+// setImageTags sets the NAME_image_tag attributes of src, at any depth,
+// to tags[NAME]. Only values that are plain strings are changed, not
+// expressions like "${var.tag}". The tokens of a value are rewritten in
+// place and the file is not formatted, so that everything else is left
+// byte for byte. It returns the new source and the number of values
+// changed.
+func setImageTags(name string, src []byte, tags map[string]string) ([]byte, int, error) {
+	f, diags := hclwrite.ParseConfig(src, name, hcl.InitialPos)
+	if diags.HasErrors() {
+		return nil, 0, diags
+	}
+	n := 0
+	var walk func(body *hclwrite.Body)
+	walk = func(body *hclwrite.Body) {
+		for attrName, attr := range body.Attributes() {
+			service, ok := strings.CutSuffix(attrName, "_image_tag")
+			tag, set := tags[service]
+			if !ok || !set {
+				continue
+			}
+			tokens := attr.Expr().BuildTokens(nil)
+			if !stringLiteral(tokens) || string(tokens[1].Bytes) == tag {
+				continue
+			}
+			tokens[1].Bytes = hclwrite.TokensForValue(cty.StringVal(tag))[1].Bytes
+			n++
+		}
+		for _, block := range body.Blocks() {
+			walk(block.Body())
+		}
+	}
+	walk(f.Body())
+
+	var buf bytes.Buffer
+	_, err := f.BuildTokens(nil).WriteTo(&buf)
+	return buf.Bytes(), n, err
+}
+
+// stringLiteral reports whether tokens are a string with no template in
+// it. Empty strings are not, as they have no token to rewrite.
+func stringLiteral(tokens hclwrite.Tokens) bool {
+	return len(tokens) == 3 &&
+		tokens[0].Type == hclsyntax.TokenOQuote &&
+		tokens[1].Type == hclsyntax.TokenQuotedLit &&
+		tokens[2].Type == hclsyntax.TokenCQuote
+}
+
+// imageTag returns the tag of an image reference, which is latest if it
+// has none.
+func imageTag(image string) (string, bool) {
+	if strings.Contains(image, "@") {
+		return "", false
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[i+1:], true
+	}
+	return "latest", true
+}
+
+// runningTags returns the tags of the images the services run, by
+// terraform name.
+func runningTags() map[string]string {
+	tags := map[string]string{}
+	for _, serviceName := range ext.SERVICES() {
+		project := ext.ProjectFor(serviceName)
+		region := ext.RegionsFor(serviceName)[0]
+		service, err := describeService(ext.Context(), serviceName, project, region)
+		ext.Check(err, serviceName+" in "+region)
+		image := service.Spec.Template.Spec.Containers[0].Image
+		tag, ok := imageTag(image)
+		if !ok {
+			ext.Die("%s runs %s by digest, not by tag", serviceName, image)
+		}
+		if !dockerTag.MatchString(tag) {
+			ext.Die("%s runs %s, which has an invalid tag %q", serviceName, image, tag)
+		}
+		name := terraformName(serviceName)
+		if other, ok := tags[name]; ok && other != tag {
+			ext.Die("services named %s run different tags: %s and %s", name, other, tag)
+		}
+		tags[name] = tag
+		fmt.Fprintln(ext.Info(), serviceName, "runs", ext.Color(tag, c.Magenta))
+	}
+	return tags
+}
+
+// terraformSetCmd rewrites the image tags in the marked main.tf files
+// and, with --branch, commits the change on a new branch.
+func terraformSetCmd(args []string) {
+	tags := map[string]string{}
+	switch {
+	case *fFromRunning && len(args) == 0:
+		tags = runningTags()
+	case !*fFromRunning && len(args) == 1:
+		if !dockerTag.MatchString(args[0]) {
+			ext.Die("invalid image tag %q", args[0])
+		}
+		for _, s := range ext.SERVICES() {
+			tags[terraformName(s)] = args[0]
+		}
+	default:
+		ext.Die("terraform set takes a TAG, or --from-running")
+	}
+
+	tf := ext.TF()
+	changed := []markedFile{}
+	for _, file := range markedMainTF(tf) {
+		b, n, err := setImageTags(file.Name, []byte(file.Content), tags)
+		ext.Check(err)
+		if n == 0 {
+			continue
+		}
+		content := string(b)
+		if !ext.DryRun() {
+			fmt.Print(ext.Diff(file.Name, file.Content, content))
+		}
+		changed = append(changed, markedFile{Name: file.Name, Content: content})
+	}
+	if len(changed) == 0 {
+		fmt.Println(c.Gray(12, "image tags are up to date"))
+		return
+	}
+	if !ext.DryRun() && !ext.Confirm(fmt.Sprintf("write %d files", len(changed))) {
+		return
+	}
+
+	if *fBranch != "" {
+		ext.Mutate(fmt.Sprintf("git -C %s checkout -b %s", quote(tf), quote(*fBranch)))
+	}
+	files := []string{}
+	for _, file := range changed {
+		ext.Check(ext.WriteFile(file.Name, []byte(file.Content), 0o644))
+		rel, err := filepath.Rel(tf, file.Name)
+		ext.Check(err)
+		files = append(files, quote(rel))
+	}
+	if *fBranch != "" {
+		assignments := []string{}
+		for _, name := range slices.Sorted(maps.Keys(tags)) {
+			assignments = append(assignments, name+"_image_tag="+tags[name])
+		}
+		message := "Set " + strings.Join(assignments, ", ")
+		ext.Mutate(fmt.Sprintf("git -C %s add -- %s", quote(tf), strings.Join(files, " ")))
+		ext.Mutate(fmt.Sprintf("git -C %s commit -m %s", quote(tf), quote(message)))
+	}
+
+	ext.Notify("terraform image tags updated")
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"gcp/lib/ext"
+)
+
+// tokenMargin is how long before its expiry a cached token is replaced.
+const tokenMargin = time.Minute
+
+// token is a cached identity token. Replayed tokens are placeholders
+// with no expiry and are kept for good.
+type token struct {
+	value   string
+	expires time.Time
+}
+
+var tokens = struct {
+	sync.Mutex
+	byAudience map[string]token
+}{byAudience: map[string]token{}}
+
+// identityToken returns an identity token for requests to a private
+// service at audience, reusing it until it is about to expire. gcloud
+// runs with CLOUDSDK_AUTH_CREDENTIAL_FILE_OVERRIDE when it is set.
+func identityToken(audience string) (string, error) {
+	tokens.Lock()
+	defer tokens.Unlock()
+
+	if t, ok := tokens.byAudience[audience]; ok && (t.expires.IsZero() || time.Until(t.expires) > tokenMargin) {
+		return t.value, nil
+	}
+	b, err := ext.ExecSecret("gcloud auth print-identity-token --audiences " + audience)
+	if err != nil {
+		// User accounts cannot ask for an audience, but their
+		// tokens are accepted by Cloud Run all the same.
+		b, err = ext.ExecSecret("gcloud auth print-identity-token")
+	}
+	if err != nil {
+		return "", fmt.Errorf("identity token: %w", err)
+	}
+	value := strings.TrimSpace(string(b))
+	if ext.Replaying() {
+		// Recordings do not keep tokens, so there is no expiry to read.
+		tokens.byAudience[audience] = token{value: value}
+		return value, nil
+	}
+	expires, err := tokenExpiry(value)
+	if err != nil {
+		return "", fmt.Errorf("identity token: %w", err)
+	}
+	tokens.byAudience[audience] = token{value: value, expires: expires}
+	return value, nil
+}
+
+// tokenExpiry reads the exp claim of a JWT.
+func tokenExpiry(jwt string) (time.Time, error) {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return time.Time{}, fmt.Errorf("not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, err
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(claims.Exp, 0), nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"gcp/lib/ext"
+
+	c "github.com/logrusorgru/aurora/v4"
+)
+
+var fCanary = flag.Int("canary", 0, "deploy with no traffic, tagged canary, then send it `percent` of traffic")
+
+const canaryTag = "canary"
+
+func trafficCmd() {
+	service := serviceInfo(ext.SERVICE(), ext.PROJECT(), ext.REGION())
+	ext.Output(service.Status.Traffic, func() { printTraffic(service.Status.Traffic) })
+}
+
+func printTraffic(traffic []Traffic) {
+	for _, t := range traffic {
+		line := fmt.Sprintf("%3d%% %s", t.Percent, t.RevisionName)
+		if t.LatestRevision {
+			line += " (latest)"
+		}
+		if t.Tag != "" {
+			line += " #" + t.Tag + " " + t.URL
+		}
+		if t.Percent > 0 {
+			line = ext.Color(line, c.Green)
+		}
+		fmt.Println(line)
+	}
+}
+
+// toRevisions returns the --to-revisions argument restoring the split
+// of the revisions that receive traffic.
+func toRevisions(traffic []Traffic) string {
+	percent := map[string]int{}
+	for _, t := range traffic {
+		if t.Percent > 0 && t.RevisionName != "" {
+			percent[t.RevisionName] += t.Percent
+		}
+	}
+	split := []string{}
+	for revision, p := range percent {
+		split = append(split, fmt.Sprintf("%s=%d", revision, p))
+	}
+	sort.Strings(split)
+	return strings.Join(split, ",")
+}
+
+func taggedURL(service Service, tag string) string {
+	for _, t := range service.Status.Traffic {
+		if t.Tag == tag {
+			return t.URL
+		}
+	}
+	return ""
+}
+
+func updateTraffic(service, project, region, to string) {
+	ext.Mutate(updateTrafficCmd(service, project, region, to))
+}
+
+func updateTrafficCmd(service, project, region, to string) string {
+	return fmt.Sprintf(
+		"gcloud run services update-traffic %s %s --region %s --project %s",
+		service, to, region, project)
+}
+
+const (
+	promote50  = "promote to 50%"
+	promote100 = "promote to 100%"
+	abort      = "abort and revert"
+)
+
+// canaryOptions are the next steps for a canary at percent. Promoting to
+// 50% is only offered while that raises its traffic, and reverting comes
+// first when the canary is not healthy.
+func canaryOptions(percent int, healthy bool) []string {
+	options := []string{}
+	if percent < 50 {
+		options = append(options, promote50)
+	}
+	options = append(options, promote100)
+	if !healthy {
+		return append([]string{abort}, options...)
+	}
+	return append(options, abort)
+}
+
+func canaryHealthy(url string) bool {
+	if err := checkHealth(url); err != nil {
+		fmt.Println(ext.Color(err.Error(), c.Red))
+		return false
+	}
+	return true
+}
+
+// canaryDeploy deploys image as a tagged revision with no traffic, sends
+// it percent of the traffic, checks its health and then lets the user
+// promote it or revert to the split it replaced.
+func canaryDeploy(serviceName, image, project, region string, percent int) {
+	before := serviceInfo(serviceName, project, region)
+	revert := toRevisions(before.Status.Traffic)
+
+	ext.Mutate(deploy(serviceName, image, project, region) + " --no-traffic --tag " + canaryTag)
+	updateTraffic(serviceName, project, region, fmt.Sprintf("--to-tags %s=%d", canaryTag, percent))
+	if ext.DryRun() {
+		return
+	}
+
+	service := serviceInfo(serviceName, project, region)
+	printTraffic(service.Status.Traffic)
+	healthy := canaryHealthy(taggedURL(service, canaryTag))
+	for {
+		switch ext.Selector(fmt.Sprintf("canary at %d%%", percent), canaryOptions(percent, healthy)) {
+		case promote50:
+			percent = 50
+			updateTraffic(serviceName, project, region, fmt.Sprintf("--to-tags %s=%d", canaryTag, percent))
+			healthy = canaryHealthy(taggedURL(service, canaryTag))
+			continue
+		case promote100:
+			updateTraffic(serviceName, project, region, "--to-latest")
+			healthCmd()
+			ext.Notify("canary promoted")
+		case abort:
+			updateTraffic(serviceName, project, region, "--to-revisions "+revert)
+			healthCmd()
+			ext.Notify("canary reverted")
+		default:
+			fmt.Println(c.Gray(12, fmt.Sprintf("canary left at %d%%", percent)))
+		}
+		return
+	}
+}
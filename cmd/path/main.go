@@ -17,10 +17,37 @@ var (
 	fExeShadows = flag.Bool("f", false, "show shadowed executables")
 )
 
+// PathEntry is a directory in $PATH.
+type PathEntry struct {
+	Dir         string `json:"dir"`
+	Executables int    `json:"executables"`
+	Exists      bool   `json:"exists"`
+	Duplicate   bool   `json:"duplicate,omitempty"`
+}
+
+// Shadow is an executable found in more than one $PATH directory;
+// the first location wins.
+type Shadow struct {
+	Name      string   `json:"name"`
+	Locations []string `json:"locations"`
+}
+
+type Report struct {
+	Entries []PathEntry `json:"entries"`
+	Shadows []Shadow    `json:"shadows,omitempty"`
+}
+
 func main() {
+	defer ext.Handle()
+
 	flag.Parse()
 
-	path := os.Getenv("PATH")
+	report := scan(os.Getenv("PATH"))
+	ext.Output(report, func() { printReport(report) })
+}
+
+func scan(path string) Report {
+	report := Report{Entries: []PathEntry{}}
 
 	m := map[string]bool{}
 	exes := map[string][]string{}
@@ -46,42 +73,52 @@ func main() {
 				exes[d.Name()] = append(exes[d.Name()], v)
 			}
 		}
+		m[v] = true
 		if dupe && !*fPathDupes {
 			continue
 		}
-		if nonexistent {
-			fmt.Print(c.CrossedOut(v), " ❌")
+		report.Entries = append(report.Entries, PathEntry{Dir: v, Executables: n, Exists: !nonexistent, Duplicate: dupe})
+	}
+
+	if *fExeShadows {
+		names := []string{}
+		for k := range exes {
+			names = append(names, k)
+		}
+		slices.Sort(names)
+		for _, exe := range names {
+			if len(exes[exe]) > 1 {
+				report.Shadows = append(report.Shadows, Shadow{Name: exe, Locations: exes[exe]})
+			}
+		}
+	}
+	return report
+}
+
+func printReport(report Report) {
+	for _, e := range report.Entries {
+		if !e.Exists {
+			fmt.Print(c.CrossedOut(e.Dir), " ❌")
 		} else {
-			fmt.Print(colorizePath(v))
+			fmt.Print(colorizePath(e.Dir))
 		}
-		fmt.Printf(" (%d)", n)
-		if *fPathDupes && m[v] {
+		fmt.Printf(" (%d)", e.Executables)
+		if e.Duplicate {
 			fmt.Print(" 🔄")
 		}
 		fmt.Println()
-		m[v] = true
 	}
 
-	if *fExeShadows {
-		sortedExes := []string{}
-		maxSz := 0
-		for k := range exes {
-			sortedExes = append(sortedExes, k)
-			if len(k) > maxSz {
-				maxSz = len(k)
-			}
-		}
-		slices.Sort(sortedExes)
-		for _, exe := range sortedExes {
-			locations := exes[exe]
-			if len(locations) == 1 {
-				continue
-			}
-			for i, location := range locations {
-				locations[i] = colorizePath(location)
-			}
-			fmt.Printf("%*s %s\n", maxSz, c.Red(exe), strings.Join(locations, ", "))
+	maxSz := 0
+	for _, s := range report.Shadows {
+		maxSz = max(maxSz, len(s.Name))
+	}
+	for _, s := range report.Shadows {
+		locations := make([]string, len(s.Locations))
+		for i, location := range s.Locations {
+			locations[i] = colorizePath(location)
 		}
+		fmt.Printf("%*s %s\n", maxSz, c.Red(s.Name), strings.Join(locations, ", "))
 	}
 }
 
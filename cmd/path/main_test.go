@@ -1,7 +1,35 @@
 package main
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 )
 
 func TestMain(t *testing.T) {}
+
+func TestScan(t *testing.T) {
+	a, b := t.TempDir(), t.TempDir()
+	for _, dir := range []string{a, b} {
+		os.WriteFile(filepath.Join(dir, "tool"), []byte("#!/bin/sh\n"), 0o755)
+	}
+	os.WriteFile(filepath.Join(b, "README"), []byte("not executable"), 0o644)
+	missing := filepath.Join(a, "missing")
+
+	*fExeShadows = true
+	defer func() { *fExeShadows = false }()
+
+	report := scan(a + ":" + b + ":" + missing + ":" + a)
+	if len(report.Entries) != 3 {
+		t.Fatalf("got %d entries, want duplicates hidden: %+v", len(report.Entries), report.Entries)
+	}
+	if e := report.Entries[1]; e.Dir != b || e.Executables != 1 || !e.Exists {
+		t.Errorf("entry = %+v", e)
+	}
+	if e := report.Entries[2]; e.Exists {
+		t.Errorf("expected %s to be missing", e.Dir)
+	}
+	if len(report.Shadows) != 1 || report.Shadows[0].Name != "tool" || len(report.Shadows[0].Locations) != 2 {
+		t.Errorf("shadows = %+v", report.Shadows)
+	}
+}
@@ -5,5 +5,7 @@ import (
 )
 
 func main() {
+	defer ext.Handle()
+
 	ext.Selector("pick one", []string{"a", "b", "c"})
 }
@@ -46,6 +46,8 @@ var (
 )
 
 func main() {
+	defer ext.Handle()
+
 	flag.Usage = func() {
 		fmt.Printf("usage: %s [flags] [A.B.C | + | [+/-]N]\n", os.Args[0])
 		fmt.Println()
@@ -134,11 +136,11 @@ func updateUvLockFile(name, version string) {
 		}
 		lines[i+2] = fmt.Sprintf(`version = "%s"`, version)
 		b := []byte(strings.Join(lines, "\n"))
-		err = os.WriteFile("uv.lock", b, 0o644)
+		err = ext.WriteFile("uv.lock", b, 0o644)
 		if err != nil {
 			ext.Die("writing uv.lock: %s", err)
 		}
-		fmt.Println("written to", c.Cyan("uv.lock"))
+		written("uv.lock")
 		break
 	}
 }
@@ -169,14 +171,20 @@ func updateVersionFile(filename, version string, content []byte) string {
 		return version
 	}
 	b := []byte(strings.Replace(string(content), version, newVersion, 1))
-	err := os.WriteFile(filename, b, 0o644)
+	err := ext.WriteFile(filename, b, 0o644)
 	if err != nil {
 		ext.Die("writing %s: %s", filename, err)
 	}
-	fmt.Println("written to", c.Cyan(filename))
+	written(filename)
 	return newVersion
 }
 
+func written(filename string) {
+	if !ext.DryRun() {
+		fmt.Println("written to", c.Cyan(filename))
+	}
+}
+
 func updateVersion(filename, version string) string {
 	fmt.Println("version", c.Yellow(version), "in", c.Cyan(filename))
 	if !semver.IsValid("v" + version) {
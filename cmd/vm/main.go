@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
 	"os/exec"
+	"path"
+	"slices"
 	"strings"
 	"time"
 
@@ -26,8 +29,17 @@ type VM struct {
 }
 
 type VMConfig struct {
-	Default string `json:"default"`
-	VMs     []VM   `json:"vms"`
+	Default string       `json:"default"`
+	VMs     []VM         `json:"vms"`
+	Retry   *RetryConfig `json:"retry"`
+}
+
+// RetryConfig overrides ext.DefaultRetry for gcloud and ssh commands.
+type RetryConfig struct {
+	Attempts   int      `json:"attempts"`
+	Backoff    string   `json:"backoff"`
+	MaxBackoff string   `json:"maxBackoff"`
+	Patterns   []string `json:"patterns"`
 }
 
 var fMachine = flag.String("m", "", "VM name or alias")
@@ -38,12 +50,14 @@ type Instance struct {
 	Name        string `json:"name"`
 	Status      string `json:"status"`
 	MachineType string `json:"machineType"`
+	Zone        string `json:"zone"`
 
 	Disks []struct {
 		DiskSizeGb string `json:"diskSizeGb"`
 	} `json:"disks"`
 
 	NetworkInterfaces []struct {
+		NetworkIP     string `json:"networkIP"`
 		AccessConfigs []struct {
 			NatIP string `json:"natIP"`
 		} `json:"accessConfigs"`
@@ -76,6 +90,8 @@ type MachineType struct {
 }
 
 func main() {
+	defer ext.Handle()
+
 	zsh.Completion(CompletionRoot)
 
 	flag.Usage = func() {
@@ -96,7 +112,7 @@ func main() {
 	}
 	flag.Parse()
 
-	args := flag.Args()
+	args := ext.Args()
 	if len(args) == 0 {
 		args = []string{"i"}
 	}
@@ -130,12 +146,16 @@ func main() {
 }
 
 func instanceInfo(vm *VM, echo bool) *Instance {
+	return instanceInfoContext(ext.Context(), vm, echo)
+}
+
+func instanceInfoContext(ctx context.Context, vm *VM, echo bool) *Instance {
 	i := Instance{}
 	cmd := fmt.Sprintf(""+
 		"gcloud compute instances describe %s "+
 		"--project %s --zone %s --format json",
 		vm.Name, vm.Project, vm.Zone)
-	ext.Check(json.Unmarshal(ext.Capture(cmd, echo), &i))
+	ext.Check(json.Unmarshal(ext.CaptureContext(ctx, cmd, echo), &i))
 	return &i
 }
 
@@ -180,6 +200,12 @@ func vmInfo() *VM {
 	config := &VMConfig{}
 	ext.Check(json.Unmarshal(b, config))
 
+	if r := config.Retry; r != nil {
+		retry, err := ext.NewRetry(r.Attempts, r.Backoff, r.MaxBackoff, r.Patterns)
+		ext.Check(err, "in", meVM)
+		ext.SetRetry(retry)
+	}
+
 	name := *fMachine
 	if name == "" {
 		name = config.Default
@@ -195,7 +221,7 @@ func vmInfo() *VM {
 		ext.Die("VM %q not found in %s", name, meVM)
 	}
 
-	fmt.Println("vm", ext.Color(vmi.Name, c.Magenta))
+	fmt.Fprintln(ext.Info(), "vm", ext.Color(vmi.Name, c.Magenta))
 
 	if vmi.GAC == "" {
 		ext.Die("gac not set in %s", meVM)
@@ -208,76 +234,139 @@ func vmInfo() *VM {
 func infoCmd() {
 	vm := vmInfo()
 	i := instanceInfo(vm, true)
-	printInstance(vm, i)
+	summary := summarize(vm, i)
+	ext.Output(summary, func() { printSummary(summary) })
+}
+
+// InstanceSummary is what vm info reports.
+type InstanceSummary struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	CPUs     int      `json:"cpus"`
+	MemoryGB float64  `json:"memoryGb"`
+	GPUs     []GPU    `json:"gpus"`
+	DiskGB   string   `json:"diskGb"`
+	IP       string   `json:"ip"`
+	Email    string   `json:"email"`
+	HTTP     bool     `json:"http"`
+	HTTPS    bool     `json:"https"`
+	Tags     []string `json:"tags"`
+	Status   string   `json:"status"`
+	Link     string   `json:"link"`
+	SSHKeys  []SSHKey `json:"sshKeys,omitempty"`
 }
 
-func onOff(tags []string, tag string) string {
-	for _, t := range tags {
-		if t == tag {
-			return "on"
+type GPU struct {
+	Type  string `json:"type"`
+	Count int    `json:"count"`
+}
+
+type SSHKey struct {
+	User    string `json:"user"`
+	Type    string `json:"type"`
+	Key     string `json:"key"`
+	Comment string `json:"comment,omitempty"`
+}
+
+func summarize(vm *VM, i *Instance) InstanceSummary {
+	mt := machineTypeInfo(vm, i)
+	summary := InstanceSummary{
+		Name:     i.Name,
+		Type:     machineTypeName(i),
+		CPUs:     mt.GuestCpus,
+		MemoryGB: float64(mt.MemoryMb) / 1024,
+		GPUs:     []GPU{},
+		DiskGB:   i.Disks[0].DiskSizeGb,
+		IP:       i.NetworkInterfaces[0].AccessConfigs[0].NatIP,
+		Email:    i.ServiceAccounts[0].Email,
+		HTTP:     slices.Contains(i.Tags.Items, "http-server"),
+		HTTPS:    slices.Contains(i.Tags.Items, "https-server"),
+		Tags:     i.Tags.Items,
+		Status:   i.Status,
+		Link:     instanceLink(vm),
+	}
+	for _, gpu := range i.GuestAccelerators {
+		parts := strings.Split(gpu.AcceleratorType, "/")
+		summary.GPUs = append(summary.GPUs, GPU{Type: parts[len(parts)-1], Count: gpu.AcceleratorCount})
+	}
+
+	if *fExtra {
+		for _, item := range i.Metadata.Items {
+			if item.Key != "ssh-keys" {
+				continue
+			}
+			for _, line := range strings.Split(strings.TrimSpace(item.Value), "\n") {
+				summary.SSHKeys = append(summary.SSHKeys, parseSSHKey(line))
+			}
 		}
 	}
+	return summary
+}
+
+// parseSSHKey parses "username:key-type base64 comment...",
+// shortening the key itself.
+func parseSSHKey(line string) SSHKey {
+	user, rest, _ := strings.Cut(line, ":")
+	fields := strings.Fields(rest)
+	key := SSHKey{User: user}
+	if len(fields) > 0 {
+		key.Type = fields[0]
+	}
+	if len(fields) > 1 {
+		b := fields[1]
+		if len(b) > 16 {
+			key.Key = b[:8] + "..." + b[len(b)-8:]
+		} else {
+			key.Key = b
+		}
+	}
+	if len(fields) > 2 {
+		key.Comment = strings.Join(fields[2:], " ")
+	}
+	return key
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
 	return "off"
 }
 
 func printInstance(vm *VM, i *Instance) {
-	mt := machineTypeInfo(vm, i)
+	printSummary(summarize(vm, i))
+}
+
+func printSummary(s InstanceSummary) {
 	fmt.Println()
-	fmt.Println("Name:   ", ext.Color(i.Name, c.Cyan))
-	fmt.Println("Type:   ", ext.Color(machineTypeName(i), c.Cyan))
-	fmt.Println("CPU:    ", ext.Color(fmt.Sprintf("%d vCPU", mt.GuestCpus), c.Cyan))
-	fmt.Println("Memory: ", ext.Color(fmt.Sprintf("%.1f GB", float64(mt.MemoryMb)/1024), c.Cyan))
-	if len(i.GuestAccelerators) > 0 {
-		for _, gpu := range i.GuestAccelerators {
-			parts := strings.Split(gpu.AcceleratorType, "/")
-			name := parts[len(parts)-1]
-			fmt.Println("GPU:    ", ext.Color(fmt.Sprintf("%dx %s", gpu.AcceleratorCount, name), c.Cyan))
+	fmt.Println("Name:   ", ext.Color(s.Name, c.Cyan))
+	fmt.Println("Type:   ", ext.Color(s.Type, c.Cyan))
+	fmt.Println("CPU:    ", ext.Color(fmt.Sprintf("%d vCPU", s.CPUs), c.Cyan))
+	fmt.Println("Memory: ", ext.Color(fmt.Sprintf("%.1f GB", s.MemoryGB), c.Cyan))
+	if len(s.GPUs) > 0 {
+		for _, gpu := range s.GPUs {
+			fmt.Println("GPU:    ", ext.Color(fmt.Sprintf("%dx %s", gpu.Count, gpu.Type), c.Cyan))
 		}
 	} else {
 		fmt.Println("GPU:    ", ext.Color("none", c.Cyan))
 	}
-	fmt.Println("Disk:   ", ext.Color(i.Disks[0].DiskSizeGb+" GB", c.Cyan))
-	fmt.Println("IP:     ", ext.Color(i.NetworkInterfaces[0].AccessConfigs[0].NatIP, c.Cyan))
-	fmt.Println("Email:  ", ext.Color(i.ServiceAccounts[0].Email, c.Cyan))
-	fmt.Println("HTTP:   ", ext.Color(onOff(i.Tags.Items, "http-server"), c.Cyan))
-	fmt.Println("HTTPS:  ", ext.Color(onOff(i.Tags.Items, "https-server"), c.Cyan))
-	if len(i.Tags.Items) > 0 {
-		fmt.Println("Tags:   ", ext.Color(strings.Join(i.Tags.Items, ", "), c.Cyan))
+	fmt.Println("Disk:   ", ext.Color(s.DiskGB+" GB", c.Cyan))
+	fmt.Println("IP:     ", ext.Color(s.IP, c.Cyan))
+	fmt.Println("Email:  ", ext.Color(s.Email, c.Cyan))
+	fmt.Println("HTTP:   ", ext.Color(onOff(s.HTTP), c.Cyan))
+	fmt.Println("HTTPS:  ", ext.Color(onOff(s.HTTPS), c.Cyan))
+	if len(s.Tags) > 0 {
+		fmt.Println("Tags:   ", ext.Color(strings.Join(s.Tags, ", "), c.Cyan))
 	}
-	fmt.Println("Status: ", ext.Color(i.Status, c.White))
+	fmt.Println("Status: ", ext.Color(s.Status, c.White))
 	fmt.Println()
-	fmt.Println("Link:   ", instanceLink(vm))
+	fmt.Println("Link:   ", s.Link)
 
 	if *fExtra {
 		fmt.Println()
 		fmt.Println(ext.Color("SSH Keys:", c.White))
-		for _, item := range i.Metadata.Items {
-			if item.Key != "ssh-keys" {
-				continue
-			}
-			for _, line := range strings.Split(strings.TrimSpace(item.Value), "\n") {
-				// format: username:key-type base64 comment...
-				user, rest, _ := strings.Cut(line, ":")
-				fields := strings.Fields(rest)
-				keyType := ""
-				comment := ""
-				if len(fields) > 0 {
-					keyType = fields[0]
-				}
-				key := ""
-				if len(fields) > 1 {
-					b := fields[1]
-					if len(b) > 16 {
-						key = b[:8] + "..." + b[len(b)-8:]
-					} else {
-						key = b
-					}
-				}
-				if len(fields) > 2 {
-					comment = strings.Join(fields[2:], " ")
-				}
-				fmt.Println(" ", ext.Color(user, c.Cyan), keyType, key, comment)
-			}
+		for _, key := range s.SSHKeys {
+			fmt.Println(" ", ext.Color(key.User, c.Cyan), key.Type, key.Key, key.Comment)
 		}
 	}
 
@@ -294,8 +383,13 @@ func pingCmd() {
 
 	ssh := "ssh " + vm.Alias + " "
 
+	// sshd may not be up yet right after start, hence the retries,
+	// but a hanging connection should not block forever.
+	ctx, cancel := ext.WithTimeout(sshTimeout)
+	defer cancel()
+
 	fmt.Print(ext.Color("✔️ ", c.Blue))
-	ext.Quiet(ssh+"hostname", 10)
+	ext.QuietContext(ctx, ssh+"hostname", 10)
 
 	fmt.Print(ext.Color("✔️ ", c.Blue))
 	ext.Quiet(ssh + "uname -a")
@@ -319,12 +413,51 @@ func pingCmd() {
 	fmt.Println()
 }
 
+// ListedInstance is one row of vm list.
+type ListedInstance struct {
+	Name        string `json:"name"`
+	Zone        string `json:"zone"`
+	MachineType string `json:"machineType"`
+	InternalIP  string `json:"internalIp"`
+	ExternalIP  string `json:"externalIp"`
+	Status      string `json:"status"`
+}
+
 func listCmd() {
 	vm := vmInfo()
 	cmd := fmt.Sprintf("gcloud compute instances list --project %s", vm.Project)
-	ext.Run(cmd)
+	if !ext.Machine() {
+		ext.Run(cmd)
+		return
+	}
+
+	instances := []Instance{}
+	ext.Check(json.Unmarshal(ext.Capture(cmd+" --format json", true), &instances))
+
+	list := []ListedInstance{}
+	for _, i := range instances {
+		item := ListedInstance{
+			Name:        i.Name,
+			Zone:        path.Base(i.Zone),
+			MachineType: machineTypeName(&i),
+			Status:      i.Status,
+		}
+		if len(i.NetworkInterfaces) > 0 {
+			item.InternalIP = i.NetworkInterfaces[0].NetworkIP
+			if len(i.NetworkInterfaces[0].AccessConfigs) > 0 {
+				item.ExternalIP = i.NetworkInterfaces[0].AccessConfigs[0].NatIP
+			}
+		}
+		list = append(list, item)
+	}
+	ext.Output(list, nil)
 }
 
+const (
+	sshTimeout    = 2 * time.Minute
+	statusTimeout = 5 * time.Minute
+)
+
 func awaitInstanceStatus(instance *Instance, status string) {
 	vm := vmInfo()
 
@@ -339,9 +472,13 @@ func awaitInstanceStatus(instance *Instance, status string) {
 		spinner.WithHiddenCursor(false),
 	)
 	s.Start()
+	defer s.Stop()
+
+	ctx, cancel := ext.WithTimeout(statusTimeout)
+	defer cancel()
 	for instance.Status != status {
-		time.Sleep(2 * time.Second)
-		*instance = *instanceInfo(vm, false)
+		ext.Check(ext.Sleep(ctx, 2*time.Second), "waiting for", status)
+		*instance = *instanceInfoContext(ctx, vm, false)
 	}
 	s.Stop()
 	fmt.Println("> status", ext.Color(instance.Status, c.White))
@@ -353,13 +490,16 @@ func startCmd() {
 
 	if instance.Status == "RUNNING" {
 		printInstance(vm, instance)
-		ext.Die(fmt.Sprintf("%q is already running", vm.Name))
+		ext.Die("%q is already running", vm.Name)
 	}
 
 	cmd := fmt.Sprintf(""+
 		"gcloud compute instances start %s --project %s --zone %s",
 		vm.Name, vm.Project, vm.Zone)
-	ext.Run(cmd)
+	ext.Mutate(cmd)
+	if ext.DryRun() {
+		return
+	}
 
 	awaitInstanceStatus(instance, "RUNNING")
 	fmt.Println(instance.NetworkInterfaces[0].AccessConfigs[0].NatIP)
@@ -384,7 +524,10 @@ func stopCmd() {
 	cmd := fmt.Sprintf(""+
 		"gcloud compute instances stop %s --project %s --zone %s",
 		vm.Name, vm.Project, vm.Zone)
-	ext.Run(cmd)
+	ext.Mutate(cmd)
+	if ext.DryRun() {
+		return
+	}
 
 	awaitInstanceStatus(instance, "TERMINATED")
 }
@@ -414,7 +557,7 @@ func configureCmd(vm *VM, instance *Instance) {
 
 	backupDir := home + "/Downloads"
 	backup := backupDir + "/ssh-config.vm-" + time.Now().Format("20060102-150405") + ".txt"
-	err = os.WriteFile(backup, b, 0o644)
+	err = ext.WriteFile(backup, b, 0o644)
 	if err != nil {
 		ext.Die("error writing backup: %s", err)
 	}
@@ -456,16 +599,18 @@ func configureCmd(vm *VM, instance *Instance) {
 
 			lines[i+1] = "  " + update
 
-			err = os.WriteFile(sshConfig, []byte(strings.Join(lines, "\n")), 0o644)
+			err = ext.WriteFile(sshConfig, []byte(strings.Join(lines, "\n")), 0o644)
 			if err != nil {
 				ext.Die("error writing ssh config: %s", err)
 			}
-			fmt.Println("updated", sshConfig)
+			if !ext.DryRun() {
+				fmt.Println("updated", sshConfig)
+			}
 		}
 		break
 	}
 	if !updated {
-		ext.Die("%q not found in ", vm.Alias, sshConfig)
+		ext.Die("%q not found in %s", vm.Alias, sshConfig)
 	}
 }
 
@@ -498,6 +643,12 @@ func editor(filename string) {
 	ext.Check(cmd.Run())
 }
 
+// Host is an ~/.ssh/config entry as listed by vm hosts.
+type Host struct {
+	Host string `json:"host"`
+	IP   string `json:"ip"`
+}
+
 func sshHostsCmd() {
 	home, err := os.UserHomeDir()
 	if err != nil {
@@ -511,6 +662,7 @@ func sshHostsCmd() {
 	t := string(b)
 	lines := strings.Split(t, "\n")
 
+	hosts := []Host{}
 	for i, line := range lines {
 		if strings.HasPrefix(line, "Host ") {
 			host := strings.TrimSpace(strings.TrimPrefix(line, "Host "))
@@ -525,10 +677,15 @@ func sshHostsCmd() {
 			if len(fields) < 2 {
 				ext.Die("expected HostName value after %q at line %d", host, i+1)
 			}
-			ip := fields[1]
-			fmt.Println(host, ip)
+			hosts = append(hosts, Host{Host: host, IP: fields[1]})
 		}
 	}
+
+	ext.Output(hosts, func() {
+		for _, h := range hosts {
+			fmt.Println(h.Host, h.IP)
+		}
+	})
 }
 
 var CompletionRoot = zsh.Args(
@@ -1,7 +1,36 @@
 package main
 
 import (
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"gcp/lib/ext"
 )
 
 func TestMain(t *testing.T) {}
+
+func TestConfigure(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	os.MkdirAll(filepath.Join(home, ".ssh"), 0o755)
+	os.MkdirAll(filepath.Join(home, "Downloads"), 0o755)
+	config := filepath.Join(home, sshConfig)
+	os.WriteFile(config, []byte("Host vmi\n  HostName 10.0.0.1\n  User me\n"), 0o644)
+
+	fake := ext.NewFake(ext.Reply{
+		Match:  `^gcloud compute instances describe box --project p --zone z`,
+		Stdout: `{"name": "box", "status": "RUNNING", "networkInterfaces": [{"accessConfigs": [{"natIP": "10.0.0.2"}]}]}`,
+	})
+	defer ext.SetRunner(ext.SetRunner(fake))
+
+	vm := &VM{Project: "p", Zone: "z", Name: "box", Alias: "vmi"}
+	configureCmd(vm, instanceInfo(vm, false))
+
+	b, _ := os.ReadFile(config)
+	lines := strings.Split(string(b), "\n")
+	if !strings.HasPrefix(lines[1], "  HostName 10.0.0.2 # previous 10.0.0.1") {
+		t.Errorf("HostName not updated: %q", lines[1])
+	}
+}
@@ -16,6 +16,8 @@ import (
 var places = []string{"github", "iproov", "vmi", "other"}
 
 func main() {
+	defer ext.Handle()
+
 	verbose := flag.Bool("v", false, "verbose")
 
 	flag.Parse()
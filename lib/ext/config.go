@@ -0,0 +1,399 @@
+package ext
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	c "github.com/logrusorgru/aurora/v4"
+)
+
+// Precedence lists the configuration layers, lowest first. A value set in
+// a later layer replaces the one from an earlier layer. The [profile]
+// sections chosen with -e are applied after all the files, in file order.
+const Precedence = "user config < repo .cr < .cr < .env < Makefile < [profile] < CR_* environment < -var"
+
+var fProfile = flag.String("e", os.Getenv("CR_ENV"), "`profile` to use, a [section] of .cr or config.toml ($CR_ENV)")
+
+var (
+	variables = map[string]string{}
+	sources   = map[string]string{}
+	flagVars  [][2]string
+)
+
+// Profile returns the profile chosen with -e or CR_ENV, or "" for none.
+func Profile() string {
+	return *fProfile
+}
+
+func init() {
+	flag.Func("var", "set a variable, `NAME=VALUE` (repeatable)", func(s string) error {
+		name, value, ok := strings.Cut(s, "=")
+		if !ok || !validName.MatchString(name) {
+			return fmt.Errorf("expected NAME=VALUE, not %q", s)
+		}
+		flagVars = append(flagVars, [2]string{name, value})
+		return nil
+	})
+}
+
+// Setting is an effective variable and the layer it came from.
+type Setting struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// Settings returns the effective variables sorted by name.
+func Settings() []Setting {
+	settings := make([]Setting, 0, len(variables))
+	for name, value := range variables {
+		settings = append(settings, Setting{Name: name, Value: value, Source: sources[name]})
+	}
+	sort.Slice(settings, func(i, j int) bool { return settings[i].Name < settings[j].Name })
+	return settings
+}
+
+// SetVariable sets a variable as if it had been loaded.
+func SetVariable(name, value string) {
+	set(name, value, "set")
+}
+
+func set(name, value, source string) {
+	variables[name] = value
+	sources[name] = source
+}
+
+// LoadVariables loads the configuration and prints the variables
+// that pick the service.
+func LoadVariables() {
+	LoadConfig()
+
+	v := map[string]string{"PROJECT": PROJECT(), "REGION": strings.Join(Regions(), ","), "IMAGE": IMAGE()}
+	gac := CLOUDSDK_AUTH_CREDENTIAL_FILE_OVERRIDE()
+	if gac != "" {
+		v["CLOUDSDK_AUTH_CREDENTIAL_FILE_OVERRIDE"] = gac
+	}
+	for k, vv := range variables {
+		if strings.HasPrefix(k, "SERVICE") {
+			v[k] = vv
+		}
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
+	Check(err)
+	fmt.Fprintln(Info(), string(b))
+}
+
+// LoadConfig reads every configuration layer in the order given by
+// Precedence.
+func LoadConfig() {
+	var files []string
+	var layers []profileLayer
+	known := map[string]bool{}
+	load := func(path, source string, parse parser) {
+		content, err := os.ReadFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return
+		}
+		Check(err)
+		vars, profiles, err := parse(content)
+		if err != nil {
+			Fail(fmt.Errorf("%s: %w", source, err))
+		}
+		for name, value := range vars {
+			set(name, value, source)
+		}
+		for name, vars := range profiles {
+			known[name] = true
+			layers = append(layers, profileLayer{name, source, vars})
+		}
+		files = append(files, source)
+	}
+
+	if path := userConfig(); path != "" {
+		load(path, tilde(path), parseUserConfig)
+	}
+	for _, dir := range repoDirs() {
+		path := filepath.Join(dir, ".cr")
+		load(path, relative(path), parseFile)
+	}
+	for _, file := range []string{".cr", ".env", "Makefile"} {
+		load(file, file, parseFile)
+	}
+	fmt.Fprintln(Info(), "variables = [", strings.Join(files, ", "), "]")
+
+	if profile := Profile(); profile != "" {
+		if !known[profile] {
+			names := slices.Sorted(maps.Keys(known))
+			Die("unknown profile %q, expected one of [%s]", profile, strings.Join(names, ", "))
+		}
+		for _, layer := range layers {
+			if layer.name != profile {
+				continue
+			}
+			for name, value := range layer.vars {
+				set(name, value, layer.source+" ["+profile+"]")
+			}
+		}
+	}
+
+	for _, kv := range os.Environ() {
+		name, value, _ := strings.Cut(kv, "=")
+		if name == "CR_ENV" {
+			continue
+		}
+		if name, ok := strings.CutPrefix(name, "CR_"); ok && validName.MatchString(name) && value != "" {
+			set(name, value, "env CR_"+name)
+		}
+	}
+	for _, kv := range flagVars {
+		set(kv[0], kv[1], "-var")
+	}
+
+	configureRetry()
+
+	if profile := Profile(); profile != "" {
+		fmt.Fprintln(Info(), "profile", ProfileBadge())
+	}
+}
+
+// ProfileBadge returns the active profile, highlighted in red when it
+// needs typed confirmation.
+func ProfileBadge() string {
+	badge := c.BrightWhite(" " + strings.ToUpper(Profile()) + " ").Bold()
+	if TypedConfirm() {
+		return badge.BgRed().String()
+	}
+	return badge.BgBlue().String()
+}
+
+type profileLayer struct {
+	name   string
+	source string
+	vars   map[string]string
+}
+
+// parser returns the top-level variables of a file and its [profile]
+// sections.
+type parser func([]byte) (map[string]string, map[string]map[string]string, error)
+
+// userConfig returns the path of config.toml under $XDG_CONFIG_HOME/gcp,
+// falling back to ~/.config/gcp.
+func userConfig() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "gcp", "config.toml")
+}
+
+// repoDirs returns the directories above the current one up to the git
+// root, outermost first. Outside a git repository there are none.
+func repoDirs() []string {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil
+	}
+	var dirs []string
+	for dir := cwd; ; {
+		if dir != cwd {
+			dirs = append(dirs, dir)
+		}
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil
+		}
+		dir = parent
+	}
+	for i, j := 0, len(dirs)-1; i < j; i, j = i+1, j-1 {
+		dirs[i], dirs[j] = dirs[j], dirs[i]
+	}
+	return dirs
+}
+
+func tilde(path string) string {
+	home, err := os.UserHomeDir()
+	if err == nil && strings.HasPrefix(path, home+string(filepath.Separator)) {
+		return "~" + path[len(home):]
+	}
+	return path
+}
+
+func relative(path string) string {
+	if rel, err := filepath.Rel(".", path); err == nil {
+		return rel
+	}
+	return path
+}
+
+// parseUserConfig reads config.toml, where tables are profiles.
+func parseUserConfig(content []byte) (map[string]string, map[string]map[string]string, error) {
+	var doc map[string]any
+	if err := toml.Unmarshal(content, &doc); err != nil {
+		return nil, nil, err
+	}
+	profiles := map[string]map[string]string{}
+	for name, value := range doc {
+		if table, ok := value.(map[string]any); ok {
+			profiles[name] = tomlVariables(table)
+		}
+	}
+	return tomlVariables(doc), profiles, nil
+}
+
+func tomlVariables(table map[string]any) map[string]string {
+	vars := map[string]string{}
+	for name, value := range table {
+		if !validName.MatchString(name) {
+			continue
+		}
+		switch value := value.(type) {
+		case map[string]any:
+			continue
+		case []any:
+			items := make([]string, len(value))
+			for i, item := range value {
+				items[i] = fmt.Sprint(item)
+			}
+			vars[name] = strings.Join(items, ",")
+		default:
+			vars[name] = fmt.Sprint(value)
+		}
+	}
+	return vars
+}
+
+// ReadVariables reads the assignments of a .env style file, with the
+// same rules as the configuration files.
+func ReadVariables(name string) (map[string]string, error) {
+	content, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	vars, _ := parseVariables(string(content))
+	return vars, nil
+}
+
+func parseFile(content []byte) (map[string]string, map[string]map[string]string, error) {
+	vars, profiles := parseVariables(string(content))
+	return vars, profiles, nil
+}
+
+var validName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+var assignment = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)\s*(::=|:=|\?=|\+=|=)\s*(.*)$`)
+
+// parseVariables reads NAME=VALUE assignments from a .cr, .env or Makefile.
+// It understands `export`, the Make operators :=, ::=, ?= and +=, quoted
+// values and trailing comments. Recipe lines and rules are skipped, and so
+// are empty values. Assignments after a [name] line go to that profile.
+func parseVariables(content string) (map[string]string, map[string]map[string]string) {
+	base := map[string]string{}
+	profiles := map[string]map[string]string{}
+	vars := base
+	for _, line := range strings.Split(content, "\n") {
+		if strings.HasPrefix(line, "\t") {
+			continue
+		}
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if name, ok := section(line); ok {
+			if profiles[name] == nil {
+				profiles[name] = map[string]string{}
+			}
+			vars = profiles[name]
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		m := assignment.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+		name, op, value := m[1], m[2], unquote(m[3])
+		switch op {
+		case "?=":
+			if _, ok := vars[name]; ok {
+				continue
+			}
+		case "+=":
+			if prev := vars[name]; prev != "" && value != "" {
+				value = prev + " " + value
+			} else if value == "" {
+				continue
+			}
+		}
+		if value == "" {
+			continue
+		}
+		vars[name] = value
+	}
+	return base, profiles
+}
+
+func section(line string) (string, bool) {
+	name, ok := strings.CutPrefix(line, "[")
+	if !ok {
+		return "", false
+	}
+	name, ok = strings.CutSuffix(name, "]")
+	return strings.TrimSpace(name), ok
+}
+
+// unquote returns a value without its quotes, or without a trailing
+// comment if it is not quoted.
+func unquote(value string) string {
+	if value == "" {
+		return ""
+	}
+	switch value[0] {
+	case '\'':
+		if end := strings.IndexByte(value[1:], '\''); end >= 0 {
+			return value[1 : end+1]
+		}
+	case '"':
+		var b strings.Builder
+		for i := 1; i < len(value); i++ {
+			ch := value[i]
+			if ch == '"' {
+				return b.String()
+			}
+			if ch == '\\' && i+1 < len(value) {
+				i++
+				switch value[i] {
+				case 'n':
+					ch = '\n'
+				case 't':
+					ch = '\t'
+				default:
+					ch = value[i]
+				}
+			}
+			b.WriteByte(ch)
+		}
+	}
+	for _, marker := range []string{" #", "\t#"} {
+		if i := strings.Index(value, marker); i >= 0 {
+			value = value[:i]
+		}
+	}
+	return strings.TrimSpace(value)
+}
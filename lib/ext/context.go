@@ -0,0 +1,55 @@
+package ext
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var fTimeout = flag.Duration("timeout", 0, "give up after `duration`, e.g. 5m (0 means no limit)")
+
+var (
+	rootCtx  context.Context
+	rootOnce sync.Once
+)
+
+// Context returns the context every command runs under. It is cancelled
+// by Ctrl-C or SIGTERM, and expires after -timeout if one was given.
+// A second Ctrl-C kills the process outright.
+func Context() context.Context {
+	rootOnce.Do(func() {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		cancel := context.CancelFunc(func() {})
+		if *fTimeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, *fTimeout)
+		}
+		go func() {
+			<-ctx.Done()
+			stop()
+			cancel()
+		}()
+		rootCtx = ctx
+	})
+	return rootCtx
+}
+
+// WithTimeout derives a per-call deadline from Context.
+func WithTimeout(d time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(Context(), d)
+}
+
+// Sleep pauses for d, returning early with an error if ctx is done.
+func Sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,111 @@
+package ext
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+
+	c "github.com/logrusorgru/aurora/v4"
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+var fDryRun = flag.Bool("dry-run", false, "print mutating commands and file writes instead of running them")
+
+// DryRun reports whether mutations are only printed.
+func DryRun() bool {
+	return *fDryRun
+}
+
+// Mutate runs a command that changes something, like ext.Run does but
+// without retries unless RETRY_MUTATIONS=true. With -dry-run it is
+// printed instead. Read-only queries should keep going through Capture
+// and Exec, which run regardless.
+func Mutate(cmd string) {
+	if DryRun() {
+		fmt.Fprintln(Info(), "\n"+Color("dry-run", c.Yellow)+" "+Color(cmd, c.White))
+		return
+	}
+	command := command(cmd, true)
+	command.Stdout = os.Stdout
+	command.Stderr = os.Stdout
+	_, err := retry.mutation().run(Context(), command)
+	Check(err)
+}
+
+// MutateInput is Mutate for a command reading input from stdin, like a
+// secret value. The input itself is never printed.
+func MutateInput(cmd string, input []byte) {
+	Check(MutateInputContext(Context(), cmd, input))
+}
+
+// MutateInputContext is the form of MutateInput returning the error.
+func MutateInputContext(ctx context.Context, cmd string, input []byte) error {
+	if DryRun() {
+		fmt.Fprintf(Info(), "\n%s %s < (%d bytes)\n", Color("dry-run", c.Yellow), Color(cmd, c.White), len(input))
+		return nil
+	}
+	command := command(cmd, true)
+	command.Stdin = input
+	command.Stdout = os.Stdout
+	command.Stderr = os.Stdout
+	_, err := retry.mutation().run(ctx, command)
+	return err
+}
+
+// MutateContext is Mutate for commands running side by side: the command
+// is not echoed and its failure is returned.
+func MutateContext(ctx context.Context, cmd string) error {
+	if DryRun() {
+		fmt.Fprintln(Info(), Color("dry-run", c.Yellow)+" "+Color(cmd, c.White))
+		return nil
+	}
+	_, err := retry.mutation().run(ctx, command(cmd, false))
+	return err
+}
+
+// WriteFile writes data to name like os.WriteFile. With -dry-run it prints
+// a diff against the current content instead.
+func WriteFile(name string, data []byte, perm fs.FileMode) error {
+	if !DryRun() {
+		return os.WriteFile(name, data, perm)
+	}
+	old, err := os.ReadFile(name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	fmt.Println("\n" + Color("dry-run", c.Yellow) + " write " + Color(name, c.White))
+	fmt.Print(Diff(name, string(old), string(data)))
+	return nil
+}
+
+// Diff returns a colored unified diff between two versions of a file.
+func Diff(name, before, after string) string {
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(before),
+		B:        difflib.SplitLines(after),
+		FromFile: name,
+		ToFile:   name,
+		Context:  3,
+	})
+	if err != nil {
+		return err.Error() + "\n"
+	}
+	lines := strings.Split(diff, "\n")
+	for i, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "+++"), strings.HasPrefix(line, "---"):
+			lines[i] = c.White(line).String()
+		case strings.HasPrefix(line, "+"):
+			lines[i] = c.Green(line).String()
+		case strings.HasPrefix(line, "-"):
+			lines[i] = c.Red(line).String()
+		case strings.HasPrefix(line, "@@"):
+			lines[i] = c.Cyan(line).String()
+		}
+	}
+	return strings.Join(lines, "\n")
+}
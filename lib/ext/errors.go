@@ -0,0 +1,131 @@
+package ext
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"strings"
+
+	"github.com/AlecAivazis/survey/v2/terminal"
+	c "github.com/logrusorgru/aurora/v4"
+)
+
+// CommandError reports an external command that failed, along with
+// the tail of what it wrote to stderr.
+type CommandError struct {
+	Cmd      string
+	ExitCode int
+	Stderr   string
+	Err      error
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Cmd, e.Err)
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+const tailLines = 20
+
+func tail(stderr []byte) string {
+	lines := strings.Split(strings.TrimRight(string(stderr), "\n"), "\n")
+	if len(lines) > tailLines {
+		lines = lines[len(lines)-tailLines:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// MissingVariableError reports a variable missing from .cr, .env or Makefile.
+type MissingVariableError struct {
+	Name string
+}
+
+func (e *MissingVariableError) Error() string {
+	return "missing " + e.Name
+}
+
+// ErrCancelled is returned when the user backs out of a prompt.
+var ErrCancelled = errors.New("cancelled")
+
+func cancelled(err error) error {
+	if errors.Is(err, terminal.InterruptErr) {
+		return ErrCancelled
+	}
+	return err
+}
+
+// Every helper that can fail has a form returning the error, like Exec,
+// Execute, Ask, Select, Lookup or ParseInt. Those that do not, like
+// Capture, Run, Confirm or Atoi, are shorthands for the commands in cmd:
+// they fail through Check, which unwinds to the Handle deferred in main,
+// or to Catch where there is no Handle above, as in a goroutine.
+
+// failure carries an error from Die or Check up to Handle or Catch.
+type failure struct {
+	err   error
+	stack []byte
+}
+
+// Fail unwinds the stack up to Handle, running deferred cleanup on the way.
+func Fail(err error) {
+	panic(&failure{err: err, stack: debug.Stack()})
+}
+
+// Handle reports a failure raised by Fail, Die or Check and exits.
+// Every main defers it first, so the terminal is restored and spinners
+// are stopped before the process exits.
+func Handle() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	f, ok := r.(*failure)
+	if !ok {
+		panic(r)
+	}
+	report(f.err, f.stack)
+	os.Exit(1)
+}
+
+// Catch stores a failure raised by Fail, Die or Check in *err, so that
+// the shorthands can be used where Handle is not above, such as in a
+// goroutine:
+//
+//	defer ext.Catch(&err)
+func Catch(err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	f, ok := r.(*failure)
+	if !ok {
+		panic(r)
+	}
+	*err = f.err
+}
+
+func report(err error, stack []byte) {
+	if errors.Is(err, ErrCancelled) || errors.Is(err, terminal.InterruptErr) {
+		fmt.Fprintln(Info(), c.Gray(12, "cancelled"))
+		return
+	}
+	if errors.Is(err, context.Canceled) {
+		fmt.Fprintln(Info(), c.Gray(12, "interrupted"))
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = fmt.Errorf("timed out: %w", err)
+	}
+	var cmd *CommandError
+	if errors.As(err, &cmd) && cmd.Stderr != "" {
+		fmt.Fprintln(Info(), "stderr:", cmd.Stderr)
+	}
+	fmt.Fprintln(Info(), Color(err.Error(), c.Red))
+	if *fDebug {
+		fmt.Fprintln(Info(), string(stack))
+	}
+}
@@ -1,13 +1,12 @@
 package ext
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"os/exec"
-	"runtime"
 	"strconv"
 	"strings"
 	"sync"
@@ -22,85 +21,174 @@ import (
 
 var fDebug = flag.Bool("debug", false, "print stack trace on errors")
 
-func Die(format string, args ...any) {
-	fmt.Println(Color(fmt.Sprintf(format+"\n", args...), c.Red))
-	if *fDebug {
-		buf := make([]byte, 4096)
-		n := runtime.Stack(buf, false)
-		fmt.Println(string(buf[:n]))
+// Args is ParseArgs, failing on a bad flag.
+func Args() []string {
+	args, err := ParseArgs()
+	Check(err)
+	return args
+}
+
+// ParseArgs returns the arguments left by flag.Parse, parsing the flags
+// found between them too, so that `cr deploy --canary 10` works.
+// Everything after "--" is returned as is.
+func ParseArgs() ([]string, error) {
+	var args []string
+	rest := flag.Args()
+	for len(rest) > 0 {
+		switch {
+		case rest[0] == "--":
+			return append(args, rest[1:]...), nil
+		case len(rest[0]) > 1 && rest[0][0] == '-':
+			if err := flag.CommandLine.Parse(rest); err != nil {
+				return nil, err
+			}
+			rest = flag.Args()
+		default:
+			args = append(args, rest[0])
+			rest = rest[1:]
+		}
 	}
-	os.Exit(1)
+	return args, nil
+}
+
+func Die(format string, args ...any) {
+	Fail(fmt.Errorf(format, args...))
 }
 
 var once sync.Once
 
-func Exec(cmd string, echo bool) *script.Pipe {
+func command(line string, echo bool) Cmd {
 	if echo {
-		fmt.Println("\n" + Color(cmd, c.White))
+		fmt.Fprintln(Info(), "\n"+Color(line, c.White))
 	}
-	pipe := script.Exec(cmd).WithStderr(stderr)
+	cmd := Cmd{Line: line}
 	gac := CLOUDSDK_AUTH_CREDENTIAL_FILE_OVERRIDE()
 	if gac != "" {
-		env := []string{"CLOUDSDK_AUTH_CREDENTIAL_FILE_OVERRIDE=" + gac}
-		pipe = pipe.WithEnv(env)
+		cmd.Env = []string{"CLOUDSDK_AUTH_CREDENTIAL_FILE_OVERRIDE=" + gac}
 		once.Do(func() {
-			fmt.Println("override", Color("CLOUDSDK_AUTH_CREDENTIAL_FILE_OVERRIDE", c.Magenta))
+			fmt.Fprintln(Info(), "override", Color("CLOUDSDK_AUTH_CREDENTIAL_FILE_OVERRIDE", c.Magenta))
 		})
 	}
-	return pipe
+	return cmd
+}
+
+// run executes cmd under the retry policy set with SetRetry.
+func run(ctx context.Context, cmd Cmd) (Result, error) {
+	return retry.run(ctx, cmd)
+}
+
+// runOnce executes cmd, turning a failure into a CommandError carrying
+// the exit code and stderr of this very invocation.
+func runOnce(ctx context.Context, cmd Cmd) (Result, error) {
+	r, err := CurrentRunner().Run(ctx, cmd)
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return r, &CommandError{Cmd: cmd.Line, ExitCode: r.ExitCode, Stderr: tail(r.Stderr), Err: err}
+	}
+	return r, nil
+}
+
+func Exec(cmd string, echo bool) ([]byte, error) {
+	return ExecContext(Context(), cmd, echo)
+}
+
+func ExecContext(ctx context.Context, cmd string, echo bool) ([]byte, error) {
+	r, err := run(ctx, command(cmd, echo))
+	return r.Stdout, err
+}
+
+// ExecSecret is Exec for a command printing a credential or a secret
+// value. It is not echoed, and -record stores its output redacted.
+func ExecSecret(cmd string) ([]byte, error) {
+	command := command(cmd, false)
+	command.Secret = true
+	r, err := run(Context(), command)
+	return r.Stdout, err
 }
 
 func Capture(cmd string, echo bool) []byte {
-	b, err := Exec(cmd, echo).Bytes()
-	Check(err, cmd)
+	return CaptureContext(Context(), cmd, echo)
+}
+
+func CaptureContext(ctx context.Context, cmd string, echo bool) []byte {
+	b, err := ExecContext(ctx, cmd, echo)
+	Check(err)
 	return b
 }
 
+// Execute runs cmd with its output going to the terminal.
+func Execute(cmd string) error {
+	return ExecuteContext(Context(), cmd)
+}
+
+func ExecuteContext(ctx context.Context, cmd string) error {
+	command := command(cmd, true)
+	command.Stdout = os.Stdout
+	command.Stderr = os.Stdout
+	_, err := run(ctx, command)
+	return err
+}
+
 func Run(cmd string) {
-	_, err := Exec(cmd, true).WithStderr(os.Stdout).Stdout()
-	Check(err, cmd)
+	Check(Execute(cmd))
 }
 
 func Quiet(cmd string, retries ...int) {
+	QuietContext(Context(), cmd, retries...)
+}
+
+func QuietContext(ctx context.Context, cmd string, retries ...int) {
 	n := 1
 	if len(retries) > 0 {
 		n = retries[0]
 	}
-	var err error
-	for i := 0; i < n; i++ {
-		_, err = Exec(cmd, false).Stdout()
-		if err == nil {
-			return
-		}
-		time.Sleep(1 * time.Second)
+	if err := Attempt(ctx, cmd, n); err != nil {
+		fmt.Fprintln(Info(), Color(cmd, c.Red))
+		Check(err, fmt.Sprintf("failed after %d attempts", n))
 	}
-	fmt.Println(Color(cmd, c.Red))
-	Check(err, fmt.Sprintf("failed after %d attempts", n))
+}
+
+// Attempt runs cmd without echoing it, up to n times whatever the
+// failure, with its output going to the terminal.
+func Attempt(ctx context.Context, cmd string, n int) error {
+	policy := Retry{Attempts: n, Backoff: 1 * time.Second, MaxBackoff: 10 * time.Second, Jitter: 0.2, Quiet: true}
+	command := command(cmd, false)
+	command.Stdout = os.Stdout
+	_, err := policy.run(ctx, command)
+	return err
 }
 
 func RunJQ(cmd string, q string) {
-	_, err := Exec(cmd, true).JQ(q).Stdout()
+	b := Capture(cmd, true)
+	_, err := script.Echo(string(b)).JQ(q).Stdout()
 	Check(err, cmd)
 }
 
-var stderr = new(bytes.Buffer)
-
+// Check fails with err, if any, annotated with extra.
 func Check(err error, extra ...string) {
 	if err != nil {
-		if stderr.Len() > 0 {
-			fmt.Println("stderr:", stderr.String())
+		if len(extra) > 0 {
+			err = fmt.Errorf("%w %s", err, strings.Join(extra, " "))
 		}
-		Die("error: %v %s", err, strings.Join(extra, " "))
+		Fail(err)
 	}
-	stderr.Reset()
 }
 
 func Atoi(s string) int {
+	n, err := ParseInt(s)
+	Check(err)
+	return n
+}
+
+// ParseInt is strconv.Atoi with an error naming the value.
+func ParseInt(s string) (int, error) {
 	n, err := strconv.Atoi(s)
 	if err != nil {
-		Die("error converting string to int: %s", err)
+		return 0, fmt.Errorf("error converting string to int: %w", err)
 	}
-	return n
+	return n, nil
 }
 
 func HumanizeSize(bytes int) string {
@@ -126,18 +214,57 @@ func Color(text string, colorizer colorFunc) string {
 	return colorizer(text).Bold().String()
 }
 
-func Confirm(message string) bool {
+// Ask asks a yes/no question, yes by default.
+func Ask(message string) (bool, error) {
 	fmt.Println()
 
 	yes := true
 	prompt := &survey.Confirm{Message: message, Default: yes}
 	err := survey.AskOne(prompt, &yes)
 	if err != nil {
-		Die("error asking question: %s", err)
+		return false, cancelled(err)
 	}
+	return yes, nil
+}
+
+func Confirm(message string) bool {
+	yes, err := Ask(message)
+	Check(err)
+	return yes
+}
+
+// TypedConfirm reports whether CONFIRM=typed, which makes ConfirmService
+// ask for the service name instead of a yes.
+func TypedConfirm() bool {
+	return variables["CONFIRM"] == "typed"
+}
+
+// ConfirmService asks before changing a service. With CONFIRM=typed the
+// user has to type the service name.
+func ConfirmService(message, service string) bool {
+	yes, err := AskService(message, service)
+	Check(err)
 	return yes
 }
 
+// AskService is the form of ConfirmService returning the error.
+func AskService(message, service string) (bool, error) {
+	if !TypedConfirm() {
+		return Ask(message)
+	}
+	fmt.Println()
+	var answer string
+	prompt := &survey.Input{Message: fmt.Sprintf("%s %s type %s to confirm:", ProfileBadge(), message, Color(service, c.Red))}
+	if err := survey.AskOne(prompt, &answer); err != nil {
+		return false, cancelled(err)
+	}
+	if strings.TrimSpace(answer) != service {
+		fmt.Println(c.Gray(12, "service name does not match"))
+		return false, nil
+	}
+	return true, nil
+}
+
 const ConsoleURL = "https://console.cloud.google.com"
 
 func Href(link, text string) string {
@@ -150,6 +277,9 @@ func ExecutableExists(name string) bool {
 }
 
 func Notify(msg string) {
+	if Replaying() || DryRun() {
+		return
+	}
 	osascript := "osascript"
 	if ExecutableExists(osascript) {
 		Quiet(fmt.Sprintf(`%s -e 'display notification "%s" with title "OK"'`, osascript, msg))
@@ -160,55 +290,17 @@ func Notify(msg string) {
 	}
 }
 
-func parseVariables(content string, values map[string]string) {
-	lines := strings.Split(content, "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
-		}
-		c := line[0:1]
-		if strings.Contains("#; \t", c) {
-			continue
-		}
-		parts := strings.Split(line, "=")
-		if len(parts) < 2 {
-			continue
-		}
-		name := strings.TrimSpace(parts[0])
-		value := strings.TrimSpace(parts[1])
-		if name == "" || value == "" {
-			continue
-		}
-		values[name] = value
-	}
-}
-
 // ---
 
-var variables = map[string]string{}
-
 func PROJECT() string {
-	projects := variables["PROJECTS"]
-	if projects == "" {
-		return v("PROJECT")
-	}
-	service := variables["SERVICE"]
-	if service == "" {
-		service = SERVICE()
-		variables["SERVICE"] = service
-	}
-	projects_overrides := strings.SplitSeq(projects, ",")
-	for override := range projects_overrides {
-		parts := strings.Split(override, ":")
-		if len(parts) < 2 {
-			Die("invalid PROJECTS format, expected SERVICE:REGION, not %s", override)
-		}
-		if parts[0] == service {
-			variables["PROJECT"] = parts[1]
-			fmt.Println("override project", c.BrightGreen(parts[1]), "for service", c.BrightGreen(service))
-			return parts[1]
-		}
+	return overridden("PROJECTS", "PROJECT", "project")
+}
+
+// ProjectFor returns the project of a service, from PROJECTS or PROJECT,
+// without touching the current service.
+func ProjectFor(service string) string {
+	if project, ok := override("PROJECTS", service); ok {
+		return project
 	}
 	return v("PROJECT")
 }
@@ -221,8 +313,8 @@ func SERVICE() string {
 	prompt := &survey.Select{Message: "service", Options: services}
 	var selection string
 	err := survey.AskOne(prompt, &selection, survey.WithValidator(survey.Required))
-	Check(err)
-	variables["SERVICE"] = selection
+	Check(cancelled(err))
+	set("SERVICE", selection, "selected")
 	return selection
 }
 
@@ -235,35 +327,90 @@ func SERVICES() []string {
 	if v == "" {
 		v = variables["SERVICE"]
 		if v == "" {
-			Die("missing SERVICE, SERVICE_NAME or SERVICE_NAMES")
+			Fail(&MissingVariableError{Name: "SERVICE, SERVICE_NAME or SERVICE_NAMES"})
 		}
 	}
 	return strings.Split(v, ",")
 }
 
+// REGION returns the region of the current service. When it runs in
+// several, the user picks one.
 func REGION() string {
-	regions := variables["REGIONS"]
-	if regions == "" {
-		return v("REGION")
+	if region != "" {
+		return region
+	}
+	regions := Regions()
+	if len(regions) == 1 {
+		return regions[0]
+	}
+	prompt := &survey.Select{Message: "region", Options: regions}
+	err := survey.AskOne(prompt, &region, survey.WithValidator(survey.Required))
+	Check(cancelled(err))
+	return region
+}
+
+// region is the one picked by REGION among several.
+var region string
+
+// Regions returns every region of the current service.
+func Regions() []string {
+	if variables["REGIONS"] == "" {
+		return RegionsFor("")
 	}
 	service := variables["SERVICE"]
 	if service == "" {
 		service = SERVICE()
-		variables["SERVICE"] = service
 	}
-	regions_overrides := strings.SplitSeq(regions, ",")
-	for override := range regions_overrides {
-		parts := strings.Split(override, ":")
+	regions := RegionsFor(service)
+	if _, ok := override("REGIONS", service); ok {
+		fmt.Fprintln(Info(), "override region", c.BrightGreen(strings.Join(regions, ", ")), "for service", c.BrightGreen(service))
+	}
+	return regions
+}
+
+// RegionsFor returns the regions of a service, from REGIONS, where they
+// are separated by | as in api:europe-west1|us-central1, or from REGION,
+// a comma separated list. It does not touch the current service.
+func RegionsFor(service string) []string {
+	if regions, ok := override("REGIONS", service); ok {
+		return strings.Split(regions, "|")
+	}
+	return strings.Split(v("REGION"), ",")
+}
+
+// overridden returns the value of name for the current service, which
+// the SERVICE:VALUE pairs in list can override.
+func overridden(list, name, what string) string {
+	if variables[list] == "" {
+		return v(name)
+	}
+	service := variables["SERVICE"]
+	if service == "" {
+		service = SERVICE()
+	}
+	if value, ok := override(list, service); ok {
+		set(name, value, list)
+		fmt.Fprintln(Info(), "override", what, c.BrightGreen(value), "for service", c.BrightGreen(service))
+		return value
+	}
+	return v(name)
+}
+
+// override looks service up in a comma separated list of SERVICE:VALUE.
+func override(list, service string) (string, bool) {
+	for entry := range strings.SplitSeq(variables[list], ",") {
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
 		if len(parts) < 2 {
-			Die("invalid REGIONS format, expected SERVICE:REGION, not %s", override)
+			Die("invalid %s format, expected SERVICE:VALUE, not %s", list, entry)
 		}
 		if parts[0] == service {
-			variables["REGION"] = parts[1]
-			fmt.Println("override region", c.BrightGreen(parts[1]), "for service", c.BrightGreen(service))
-			return parts[1]
+			return parts[1], true
 		}
 	}
-	return v("REGION")
+	return "", false
 }
 
 func IMAGE() string {
@@ -282,11 +429,18 @@ func TF() string {
 	return v("TF")
 }
 
-func v(name string) string {
+// Lookup returns the value of a variable loaded by LoadVariables.
+func Lookup(name string) (string, error) {
 	v := variables[name]
 	if v == "" {
-		Die("missing %s", name)
+		return "", &MissingVariableError{Name: name}
 	}
+	return v, nil
+}
+
+func v(name string) string {
+	v, err := Lookup(name)
+	Check(err)
 	return v
 }
 
@@ -296,49 +450,42 @@ func CLOUDSDK_AUTH_CREDENTIAL_FILE_OVERRIDE() string {
 
 // ---
 
-func LoadVariables() {
-	files := []string{".cr", ".env", "Makefile"}
-	fmt.Println("variables = [", strings.Join(files, ", "), "]")
-
-	for _, file := range files {
-		content, err := os.ReadFile(file)
-		if err == nil {
-			parseVariables(string(content), variables)
-		}
-	}
-	v := map[string]string{
-		"PROJECT": PROJECT(),
-		"REGION":  REGION(),
-		"IMAGE":   IMAGE(),
-	}
-	if CLOUDSDK_AUTH_CREDENTIAL_FILE_OVERRIDE() != "" {
-		v["CLOUDSDK_AUTH_CREDENTIAL_FILE_OVERRIDE"] = CLOUDSDK_AUTH_CREDENTIAL_FILE_OVERRIDE()
-	}
-	if t := variables["SERVICE"]; t != "" {
-		v["SERVICE"] = t
+// configureRetry applies RETRY_ATTEMPTS, RETRY_BACKOFF, RETRY_MAX_BACKOFF,
+// RETRY_PATTERNS (comma separated) and RETRY_MUTATIONS=true on top of
+// DefaultRetry.
+func configureRetry() {
+	attempts := 0
+	if t := variables["RETRY_ATTEMPTS"]; t != "" {
+		attempts = Atoi(t)
 	}
-	if t := variables["SERVICE_NAME"]; t != "" {
-		v["SERVICE_NAME"] = t
+	var patterns []string
+	if t := variables["RETRY_PATTERNS"]; t != "" {
+		patterns = strings.Split(t, ",")
 	}
-	if t := variables["SERVICE_NAMES"]; t != "" {
-		v["SERVICE_NAMES"] = t
-	}
-	b, err := json.MarshalIndent(v, "", "  ")
+	r, err := NewRetry(attempts, variables["RETRY_BACKOFF"], variables["RETRY_MAX_BACKOFF"], patterns)
 	Check(err)
-	fmt.Println(string(b))
+	r.Mutations = variables["RETRY_MUTATIONS"] == "true"
+	SetRetry(r)
 }
 
-func SetVariable(name, value string) {
-	variables[name] = value
+// Selector returns the selected option, or "" if the user cancelled.
+func Selector(prompt string, options []string) string {
+	option, err := Select(prompt, options)
+	if errors.Is(err, ErrCancelled) {
+		return ""
+	}
+	Check(err)
+	return option
 }
 
-func Selector(prompt string, options []string) string {
+// Select lets the user pick one of the options with the arrow keys.
+func Select(prompt string, options []string) (string, error) {
 	fmt.Print(c.BrightYellow(prompt))
 	fmt.Println(" (use ↑↓ to select, press ↵ to select, ␛ or 'q' to cancel):")
 
 	oldState, err := term.MakeRaw(int(os.Stdin.Fd()))
 	if err != nil {
-		Die("setting terminal to raw mode: %s", err)
+		return "", fmt.Errorf("setting terminal to raw mode: %w", err)
 	}
 	defer term.Restore(int(os.Stdin.Fd()), oldState)
 
@@ -359,17 +506,17 @@ func Selector(prompt string, options []string) string {
 		}
 		n, err := os.Stdin.Read(buf)
 		if err != nil {
-			Die("read stdin: %s", err)
+			return "", fmt.Errorf("read stdin: %w", err)
 		}
 
 		// ESC or Ctrl+C to cancel
 		if n == 1 && (buf[0] == 27 || buf[0] == 3 || buf[0] == 'q') {
 			fmt.Println(c.Gray(12, "cancelled\r"))
-			return ""
+			return "", ErrCancelled
 		}
 
 		if n == 1 && buf[0] == 13 {
-			return options[selected]
+			return options[selected], nil
 		}
 
 		if n == 3 && buf[0] == 27 && buf[1] == 91 {
@@ -387,6 +534,13 @@ func Selector(prompt string, options []string) string {
 }
 
 func FuzzySelector(prompt string, options []string) string {
+	option, err := FuzzySelect(prompt, options)
+	Check(err)
+	return option
+}
+
+// FuzzySelect lets the user pick one of the options, filtering as they type.
+func FuzzySelect(prompt string, options []string) (string, error) {
 	prompt = fmt.Sprintf("%s (use ↑↓ to select, press ↵ to select, control-c to break):", prompt)
 	selected := 0
 	err := survey.AskOne(&survey.Select{
@@ -396,6 +550,8 @@ func FuzzySelector(prompt string, options []string) string {
 			return strings.Contains(optValue, filterValue)
 		},
 	}, &selected)
-	Check(err)
-	return options[selected]
+	if err != nil {
+		return "", cancelled(err)
+	}
+	return options[selected], nil
 }
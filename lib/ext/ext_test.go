@@ -1,7 +1,13 @@
 package ext
 
 import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestHumanizeSize(t *testing.T) {
@@ -22,3 +28,316 @@ func TestHumanizeSize(t *testing.T) {
 		}
 	}
 }
+
+func TestFakeRunner(t *testing.T) {
+	fake := NewFake(
+		Reply{Match: `^gcloud run services describe`, Stdout: `{"url": "https://x"}`},
+		Reply{Match: `^ssh vmi hostname$`, ExitCode: 255, Stderr: "Permission denied (publickey)", Once: true},
+		Reply{Match: `^ssh vmi hostname$`, Stdout: "vmi\n"},
+	)
+	defer SetRunner(SetRunner(fake))
+
+	b := Capture("gcloud run services describe api --format json", false)
+	if string(b) != `{"url": "https://x"}` {
+		t.Errorf("Capture = %q", b)
+	}
+
+	if _, err := Exec("ssh vmi hostname", false); err == nil {
+		t.Errorf("expected first ssh to fail")
+	}
+	if b, err := Exec("ssh vmi hostname", false); err != nil || string(b) != "vmi\n" {
+		t.Errorf("second ssh = %q, %v", b, err)
+	}
+
+	if _, err := Exec("gcloud compute instances list", false); err == nil {
+		t.Errorf("expected unmatched command to fail")
+	}
+	if n := len(fake.Lines()); n != 4 {
+		t.Errorf("got %d calls, want 4", n)
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	dir := t.TempDir()
+	fake := NewFake(
+		Reply{Match: `^gcloud compute instances describe`, Stdout: `{"status": "STAGING"}`, Once: true},
+		Reply{Match: `^gcloud compute instances describe`, Stdout: `{"status": "RUNNING"}`},
+		Reply{Match: `^gcloud run deploy`, Stderr: "PERMISSION_DENIED", ExitCode: 1},
+	)
+	recorder, err := NewRecorder(fake, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	describe := Cmd{Line: "gcloud compute instances describe vm", Env: []string{"A=1"}}
+	recorder.Run(ctx, describe)
+	recorder.Run(ctx, describe)
+	recorder.Run(ctx, Cmd{Line: "gcloud run deploy api"})
+
+	replayer, err := NewReplayer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"STAGING", "RUNNING", "RUNNING"} {
+		r, err := replayer.Run(ctx, describe)
+		if err != nil || !strings.Contains(string(r.Stdout), want) {
+			t.Errorf("replay = %q, %v; want %s", r.Stdout, err, want)
+		}
+	}
+	r, err := replayer.Run(ctx, Cmd{Line: "gcloud run deploy api"})
+	if err == nil || r.ExitCode != 1 || string(r.Stderr) != "PERMISSION_DENIED" {
+		t.Errorf("replay deploy = %+v, %v", r, err)
+	}
+	if _, err := replayer.Run(ctx, Cmd{Line: "gcloud run deploy web"}); err == nil {
+		t.Errorf("expected missing recording to fail")
+	}
+}
+
+func TestRecordSecret(t *testing.T) {
+	dir := t.TempDir()
+	recorder, err := NewRecorder(NewFake(Reply{Match: `^gcloud auth`, Stdout: "eyJ.token.sig"}), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetRunner(SetRunner(recorder))
+
+	b, err := ExecSecret("gcloud auth print-identity-token")
+	if err != nil || string(b) != "eyJ.token.sig" {
+		t.Errorf("ExecSecret = %q, %v", b, err)
+	}
+	fixture, _ := os.ReadFile(filepath.Join(dir, "0001.json"))
+	if strings.Contains(string(fixture), "eyJ") || !strings.Contains(string(fixture), redacted) {
+		t.Errorf("recorded %s", fixture)
+	}
+}
+
+func TestFailures(t *testing.T) {
+	SetVariable("PROJECT", "")
+	_, err := Lookup("PROJECT")
+	var missing *MissingVariableError
+	if !errors.As(err, &missing) || missing.Name != "PROJECT" {
+		t.Errorf("Lookup = %v; want MissingVariableError", err)
+	}
+
+	defer SetRunner(SetRunner(NewFake(
+		Reply{Match: `^true$`, Stderr: "warning: earlier command"},
+		Reply{Match: `^false$`, Stderr: "nope", ExitCode: 1},
+	)))
+	cleanedUp := false
+	func() {
+		defer func() {
+			f, ok := recover().(*failure)
+			var cmd *CommandError
+			if !ok || !errors.As(f.err, &cmd) {
+				t.Fatalf("expected a CommandError failure, got %v", f)
+			}
+			if cmd.Cmd != "false" || cmd.ExitCode != 1 || cmd.Stderr != "nope" {
+				t.Errorf("CommandError = %+v", cmd)
+			}
+		}()
+		defer func() { cleanedUp = true }()
+		Capture("true", false)
+		Capture("false", false)
+	}()
+	if !cleanedUp {
+		t.Errorf("deferred cleanup did not run")
+	}
+}
+
+func TestCancelledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := Sleep(ctx, time.Hour); !errors.Is(err, context.Canceled) {
+		t.Errorf("Sleep = %v; want context.Canceled", err)
+	}
+
+	defer SetRunner(SetRunner(NewFake(Reply{Match: `^gcloud`})))
+	_, err := ExecContext(ctx, "gcloud run services list", false)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("ExecContext = %v; want context.Canceled", err)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	fake := NewFake(
+		Reply{Match: `^gcloud run deploy`, Stderr: "ERROR: RESOURCE_EXHAUSTED", ExitCode: 1, Once: true},
+		Reply{Match: `^gcloud run deploy`, Stderr: "ERROR: (gcloud) 503 Service Unavailable", ExitCode: 1, Once: true},
+		Reply{Match: `^gcloud run deploy`, Stdout: "done"},
+		Reply{Match: `^gcloud run services describe`, Stderr: "PERMISSION_DENIED", ExitCode: 1},
+	)
+	defer SetRunner(SetRunner(fake))
+	defer SetRetry(DefaultRetry)
+	SetRetry(Retry{Attempts: 3, Backoff: time.Millisecond, Patterns: TransientPatterns, Quiet: true})
+
+	b, err := Exec("gcloud run deploy api", false)
+	if err != nil || string(b) != "done" {
+		t.Errorf("Exec = %q, %v; want done after two retries", b, err)
+	}
+	if _, err := Exec("gcloud run services describe api", false); err == nil {
+		t.Errorf("expected PERMISSION_DENIED to fail")
+	}
+	if n := len(fake.Lines()); n != 4 {
+		t.Errorf("got %d calls, want 3 for deploy and 1 for describe", n)
+	}
+}
+
+func TestRetryMatchesStderrOnly(t *testing.T) {
+	fake := NewFake(
+		Reply{Match: `describe api-00503-xyz`, Stderr: "ERROR: NOT_FOUND", ExitCode: 1},
+		Reply{Match: `^gcloud secrets versions add`, Stderr: "ERROR: HTTPError 503", ExitCode: 1},
+	)
+	defer SetRunner(SetRunner(fake))
+	defer SetRetry(DefaultRetry)
+	SetRetry(Retry{Attempts: 3, Backoff: time.Millisecond, Patterns: TransientPatterns, Quiet: true})
+
+	if _, err := Exec("gcloud run revisions describe api-00503-xyz", false); err == nil {
+		t.Errorf("expected NOT_FOUND to fail")
+	}
+	if err := MutateContext(context.Background(), "gcloud secrets versions add db --data-file=-"); err == nil {
+		t.Errorf("expected the mutation to fail")
+	}
+	if n := len(fake.Lines()); n != 2 {
+		t.Errorf("got %d calls, want 1 for describe and 1 for the mutation: %v", n, fake.Lines())
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	r := Retry{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	for attempt, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if got := r.Delay(attempt + 1); got != want {
+			t.Errorf("Delay(%d) = %s; want %s", attempt+1, got, want)
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	defer func(v bool) { *fDryRun = v }(*fDryRun)
+	*fDryRun = true
+	fake := NewFake(Reply{Match: `.`})
+	defer SetRunner(SetRunner(fake))
+
+	Mutate("gcloud run deploy api --image x")
+	if n := len(fake.Lines()); n != 0 {
+		t.Errorf("dry-run executed %d commands", n)
+	}
+
+	name := filepath.Join(t.TempDir(), "VERSION.txt")
+	os.WriteFile(name, []byte("1.0.0\n"), 0o644)
+	if err := WriteFile(name, []byte("1.0.1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(name); string(b) != "1.0.0\n" {
+		t.Errorf("dry-run wrote %q", b)
+	}
+	if diff := Diff("v", "1.0.0\n", "1.0.1\n"); !strings.Contains(diff, "+1.0.1") || !strings.Contains(diff, "-1.0.0") {
+		t.Errorf("Diff = %q", diff)
+	}
+}
+
+func TestYAML(t *testing.T) {
+	v := struct {
+		Name string   `json:"name"`
+		On   string   `json:"on"`
+		Tags []string `json:"tags"`
+	}{"api", "yes", []string{"a"}}
+	b, err := toYAML(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "name: api\n\"on\": \"yes\"\ntags:\n  - a\n"
+	if string(b) != want {
+		t.Errorf("toYAML = %q; want %q", b, want)
+	}
+}
+
+func TestParseVariables(t *testing.T) {
+	content := `# comment
+export PROJECT=acme-dev
+REGION := europe-west1 # default region
+URL="https://x/?a=b&c=d"
+NAME ?= app
+NAME ?= other
+FLAGS = -v
+FLAGS += --quiet
+QUOTED='a # b'
+EMPTY=
+
+deploy: build
+	REGION=ignored gcloud run deploy
+
+[prod]
+PROJECT=acme-prod
+`
+	got, profiles := parseVariables(content)
+	want := map[string]string{
+		"PROJECT": "acme-dev",
+		"REGION":  "europe-west1",
+		"URL":     "https://x/?a=b&c=d",
+		"NAME":    "app",
+		"FLAGS":   "-v --quiet",
+		"QUOTED":  "a # b",
+	}
+	if len(got) != len(want) {
+		t.Errorf("parseVariables = %v; want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %q; want %q", k, got[k], v)
+		}
+	}
+	if p := profiles["prod"]["PROJECT"]; p != "acme-prod" {
+		t.Errorf("[prod] PROJECT = %q; want acme-prod", p)
+	}
+}
+
+func TestRegionsFor(t *testing.T) {
+	defer func(v map[string]string) { variables = v }(variables)
+	variables = map[string]string{
+		"REGION":  "europe-west1,us-central1",
+		"REGIONS": "web:asia-east1|europe-west4",
+	}
+	if got := RegionsFor("api"); strings.Join(got, " ") != "europe-west1 us-central1" {
+		t.Errorf("RegionsFor(api) = %v", got)
+	}
+	if got := RegionsFor("web"); strings.Join(got, " ") != "asia-east1 europe-west4" {
+		t.Errorf("RegionsFor(web) = %v", got)
+	}
+}
+
+func TestCatch(t *testing.T) {
+	defer SetRunner(SetRunner(NewFake(Reply{Match: `^false$`, ExitCode: 1})))
+	done := make(chan error)
+	go func() {
+		var err error
+		defer func() { done <- err }()
+		defer Catch(&err)
+		Capture("false", false)
+	}()
+	var cmd *CommandError
+	if err := <-done; !errors.As(err, &cmd) || cmd.Cmd != "false" {
+		t.Errorf("Catch = %v; want the CommandError of false", err)
+	}
+
+	if _, err := ParseInt("ten"); err == nil {
+		t.Errorf("ParseInt(ten) succeeded")
+	}
+}
+
+func TestLoadConfigOrder(t *testing.T) {
+	defer func(v, s map[string]string) { variables, sources = v, s }(variables, sources)
+	variables, sources = map[string]string{}, map[string]string{}
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Chdir(t.TempDir())
+	os.WriteFile(".cr", []byte("PROJECT=from-cr\nREGION=europe-west1\nNAME=api\n"), 0o644)
+	os.WriteFile(".env", []byte("PROJECT=from-env\nREGION=us-central1\n"), 0o644)
+	os.WriteFile("Makefile", []byte("PROJECT := from-makefile\n"), 0o644)
+
+	LoadConfig()
+	want := map[string]string{"PROJECT": "from-makefile", "REGION": "us-central1", "NAME": "api"}
+	for name, value := range want {
+		if variables[name] != value {
+			t.Errorf("%s = %q from %s; want %q", name, variables[name], sources[name], value)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package ext
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var fOutput = flag.String("output", "table", "output `format`: table, json or yaml")
+
+const (
+	Table = "table"
+	JSON  = "json"
+	YAML  = "yaml"
+)
+
+// Format returns the output format chosen with -output.
+func Format() string {
+	switch *fOutput {
+	case Table, JSON, YAML:
+		return *fOutput
+	}
+	Die("unknown output format %q, expected table, json or yaml", *fOutput)
+	return ""
+}
+
+// Machine reports whether results are printed for other programs to read.
+func Machine() bool {
+	return Format() != Table
+}
+
+// Info is where progress messages go: stdout for people, stderr when
+// stdout carries json or yaml.
+func Info() io.Writer {
+	if *fOutput != Table && *fOutput != "" {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// Output prints v as json or yaml, or calls table for the human format.
+func Output(v any, table func()) {
+	switch Format() {
+	case JSON:
+		b, err := json.MarshalIndent(v, "", "  ")
+		Check(err)
+		fmt.Println(string(b))
+	case YAML:
+		b, err := toYAML(v)
+		Check(err)
+		fmt.Print(string(b))
+	default:
+		table()
+	}
+}
+
+// toYAML goes through json so the json tags name the fields, and through
+// a yaml.Node so the field order is kept.
+func toYAML(v any) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var node yaml.Node
+	if err := yaml.Unmarshal(b, &node); err != nil {
+		return nil, err
+	}
+	blockStyle(&node)
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&node); err != nil {
+		return nil, err
+	}
+	err = enc.Close()
+	return buf.Bytes(), err
+}
+
+// blockStyle drops the flow style and quotes json left on the nodes,
+// except for strings that YAML 1.1 readers would take for booleans.
+func blockStyle(n *yaml.Node) {
+	if n.Kind != yaml.ScalarNode || !oldBool(n.Value) {
+		n.Style = 0
+	}
+	for _, child := range n.Content {
+		blockStyle(child)
+	}
+}
+
+func oldBool(s string) bool {
+	switch strings.ToLower(s) {
+	case "y", "n", "yes", "no", "on", "off":
+		return true
+	}
+	return false
+}
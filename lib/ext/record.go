@@ -0,0 +1,187 @@
+package ext
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	c "github.com/logrusorgru/aurora/v4"
+)
+
+var (
+	fRecord = flag.String("record", os.Getenv("GCP_RECORD"), "record executed commands into `dir` ($GCP_RECORD)")
+	fReplay = flag.String("replay", os.Getenv("GCP_REPLAY"), "replay commands recorded in `dir` instead of running them ($GCP_REPLAY)")
+)
+
+// redacted replaces the output of secret commands in recordings, which
+// are meant to be shared.
+const redacted = "REDACTED"
+
+// Recording is one executed command as stored in a fixture directory.
+type Recording struct {
+	Cmd    string   `json:"cmd"`
+	Env    []string `json:"env,omitempty"`
+	Stdout string   `json:"stdout"`
+	Stderr string   `json:"stderr"`
+	Exit   int      `json:"exit"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// Recorder runs commands through another Runner and stores each of them
+// as a numbered JSON file in Dir.
+type Recorder struct {
+	Runner Runner
+	Dir    string
+
+	mu sync.Mutex
+	n  int
+}
+
+func NewRecorder(r Runner, dir string) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	existing, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{Runner: r, Dir: dir, n: len(existing)}, nil
+}
+
+func (r *Recorder) Run(ctx context.Context, cmd Cmd) (Result, error) {
+	result, err := r.Runner.Run(ctx, cmd)
+
+	rec := Recording{
+		Cmd:    cmd.Line,
+		Env:    cmd.Env,
+		Stdout: string(result.Stdout),
+		Stderr: string(result.Stderr),
+		Exit:   result.ExitCode,
+	}
+	if cmd.Secret {
+		rec.Stdout = redacted
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	b, merr := json.MarshalIndent(rec, "", "  ")
+	if merr != nil {
+		return result, merr
+	}
+
+	r.mu.Lock()
+	r.n++
+	name := filepath.Join(r.Dir, fmt.Sprintf("%04d.json", r.n))
+	r.mu.Unlock()
+
+	if werr := os.WriteFile(name, append(b, '\n'), 0o644); werr != nil {
+		return result, werr
+	}
+	return result, err
+}
+
+// Replayer answers commands from a fixture directory written by a Recorder.
+// Identical command lines are answered in recording order; once they run
+// out, the last one keeps being replayed, so polling loops settle on the
+// final recorded state.
+type Replayer struct {
+	mu         sync.Mutex
+	recordings []Recording
+	used       []bool
+}
+
+func NewReplayer(dir string) (*Replayer, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no recordings in %s", dir)
+	}
+	slices.Sort(names)
+
+	r := &Replayer{}
+	for _, name := range names {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		rec := Recording{}
+		if err := json.Unmarshal(b, &rec); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		r.recordings = append(r.recordings, rec)
+	}
+	r.used = make([]bool, len(r.recordings))
+	return r, nil
+}
+
+func (r *Replayer) Run(ctx context.Context, cmd Cmd) (Result, error) {
+	if err := ctx.Err(); err != nil {
+		return Result{ExitCode: -1}, err
+	}
+	r.mu.Lock()
+	last := -1
+	found := -1
+	for i, rec := range r.recordings {
+		if rec.Cmd != cmd.Line {
+			continue
+		}
+		last = i
+		if !r.used[i] {
+			found = i
+			r.used[i] = true
+			break
+		}
+	}
+	r.mu.Unlock()
+
+	if found < 0 {
+		found = last
+	}
+	if found < 0 {
+		return Result{ExitCode: 127}, fmt.Errorf("no recording for: %s", cmd.Line)
+	}
+	rec := r.recordings[found]
+
+	if cmd.Stdout != nil {
+		io.WriteString(cmd.Stdout, rec.Stdout)
+	}
+	if cmd.Stderr != nil {
+		io.WriteString(cmd.Stderr, rec.Stderr)
+	}
+	result := Result{Stdout: []byte(rec.Stdout), Stderr: []byte(rec.Stderr), ExitCode: rec.Exit}
+	if rec.Error != "" {
+		return result, errors.New(rec.Error)
+	}
+	return result, nil
+}
+
+// Replaying reports whether commands are answered from recordings.
+func Replaying() bool {
+	return *fReplay != ""
+}
+
+func defaultRunner() Runner {
+	var r Runner = ExecRunner{}
+	if *fReplay != "" {
+		replayer, err := NewReplayer(*fReplay)
+		Check(err)
+		fmt.Fprintln(Info(), "replay", Color(*fReplay, c.Magenta))
+		r = replayer
+	}
+	if *fRecord != "" {
+		recorder, err := NewRecorder(r, *fRecord)
+		Check(err)
+		fmt.Fprintln(Info(), "record", Color(*fRecord, c.Magenta))
+		r = recorder
+	}
+	return r
+}
@@ -0,0 +1,175 @@
+package ext
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"strings"
+	"time"
+
+	c "github.com/logrusorgru/aurora/v4"
+)
+
+// Retry is a policy for re-running commands that failed transiently.
+type Retry struct {
+	Attempts   int           // total attempts; 1 means no retries
+	Backoff    time.Duration // delay before the second attempt, doubled after each one
+	MaxBackoff time.Duration // upper bound for the delay
+	Jitter     float64       // fraction of the delay that is randomised, 0..1
+	Patterns   []string      // stderr substrings that make a failure retryable; none means any failure
+	Quiet      bool          // do not announce retries
+	Mutations  bool          // retry the commands run by Mutate too, which may not be safe to repeat
+}
+
+// TransientPatterns match gcloud and network failures worth retrying.
+var TransientPatterns = []string{
+	"RESOURCE_EXHAUSTED",
+	"UNAVAILABLE",
+	"Quota exceeded",
+	"HTTPError 502",
+	"HTTPError 503",
+	"HTTP 502",
+	"HTTP 503",
+	"code=502",
+	"code=503",
+	"502 Bad Gateway",
+	"503 Service Unavailable",
+	"connection reset",
+	"connection refused",
+	"TLS handshake timeout",
+	"i/o timeout",
+	"problem refreshing your current auth tokens",
+}
+
+// DefaultRetry is applied to every command unless SetRetry says otherwise.
+var DefaultRetry = Retry{
+	Attempts:   3,
+	Backoff:    1 * time.Second,
+	MaxBackoff: 30 * time.Second,
+	Jitter:     0.2,
+	Patterns:   TransientPatterns,
+}
+
+var retry = DefaultRetry
+
+// SetRetry replaces the policy applied to every command.
+func SetRetry(r Retry) {
+	retry = r
+}
+
+// NewRetry builds a policy from configuration values, keeping the
+// defaults for whatever is empty. Patterns are added to TransientPatterns.
+func NewRetry(attempts int, backoff, maxBackoff string, patterns []string) (Retry, error) {
+	r := DefaultRetry
+	if attempts > 0 {
+		r.Attempts = attempts
+	}
+	var err error
+	if backoff != "" {
+		if r.Backoff, err = time.ParseDuration(backoff); err != nil {
+			return r, fmt.Errorf("retry backoff: %w", err)
+		}
+	}
+	if maxBackoff != "" {
+		if r.MaxBackoff, err = time.ParseDuration(maxBackoff); err != nil {
+			return r, fmt.Errorf("retry max backoff: %w", err)
+		}
+	}
+	if len(patterns) > 0 {
+		r.Patterns = append(append([]string{}, TransientPatterns...), patterns...)
+	}
+	return r, nil
+}
+
+// Retryable reports whether err is worth another attempt. For a failed
+// command the patterns are matched against its stderr and error, not
+// its command line, where a revision name like api-00503-xyz would match.
+func (r Retry) Retryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if len(r.Patterns) == 0 {
+		return true
+	}
+	text := err.Error()
+	var cmd *CommandError
+	if errors.As(err, &cmd) {
+		text = cmd.Stderr + "\n" + cmd.Err.Error()
+	}
+	text = strings.ToLower(text)
+	for _, p := range r.Patterns {
+		if strings.Contains(text, strings.ToLower(p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// mutation is the policy for Mutate: no retries unless Mutations is set,
+// since a failure may come after the change was made, and repeating it
+// would, for instance, add a second secret version.
+func (r Retry) mutation() Retry {
+	if !r.Mutations {
+		r.Attempts = 1
+	}
+	return r
+}
+
+// Delay returns the pause after the given failed attempt, counting from 1.
+func (r Retry) Delay(attempt int) time.Duration {
+	d := r.Backoff << (attempt - 1)
+	if r.MaxBackoff > 0 && (d > r.MaxBackoff || d <= 0) {
+		d = r.MaxBackoff
+	}
+	if r.Jitter > 0 {
+		spread := float64(d) * r.Jitter
+		d += time.Duration(spread * (2*rand.Float64() - 1))
+	}
+	return d
+}
+
+// Do calls fn until it succeeds, fails with a non-retryable error,
+// runs out of attempts or ctx is done.
+func (r Retry) Do(ctx context.Context, fn func() error) error {
+	attempts := max(r.Attempts, 1)
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if attempt >= attempts || !r.Retryable(err) {
+			return err
+		}
+		d := r.Delay(attempt)
+		if !r.Quiet {
+			fmt.Fprintln(Info(), Color(fmt.Sprintf("retrying in %s (%d/%d): %v", d.Round(time.Millisecond), attempt+1, attempts, err), c.Yellow))
+		}
+		if serr := Sleep(ctx, d); serr != nil {
+			return err
+		}
+	}
+}
+
+func (r Retry) run(ctx context.Context, cmd Cmd) (res Result, err error) {
+	err = r.Do(ctx, func() error {
+		res, err = runOnce(ctx, cmd)
+		return err
+	})
+	return res, err
+}
+
+// Capture is ext.Capture under this policy.
+func (r Retry) Capture(cmd string, echo bool) []byte {
+	res, err := r.run(Context(), command(cmd, echo))
+	Check(err)
+	return res.Stdout
+}
+
+// Run is ext.Run under this policy.
+func (r Retry) Run(cmd string) {
+	command := command(cmd, true)
+	command.Stdout = os.Stdout
+	command.Stderr = os.Stdout
+	_, err := r.run(Context(), command)
+	Check(err)
+}
@@ -0,0 +1,171 @@
+package ext
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"sync"
+	"time"
+
+	"mvdan.cc/sh/v3/shell"
+)
+
+// Cmd is a single external command invocation.
+type Cmd struct {
+	Line   string    // command line, split and expanded like a shell would
+	Env    []string  // NAME=VALUE pairs added to the current environment
+	Stdout io.Writer // if set, stdout is streamed here as well as captured
+	Stderr io.Writer // if set, stderr is streamed here as well as captured
+	Stdin  []byte    // if set, fed to the command's stdin; never recorded
+	Secret bool      // stdout is a credential or secret value; recorded redacted
+}
+
+// Result is what a command left behind.
+type Result struct {
+	Stdout   []byte
+	Stderr   []byte
+	ExitCode int
+}
+
+// Runner executes external commands. Everything in the Exec family goes
+// through the package runner, so tests can swap in a Fake. A runner stops
+// the command when ctx is done.
+type Runner interface {
+	Run(ctx context.Context, cmd Cmd) (Result, error)
+}
+
+var (
+	runner     Runner
+	runnerOnce sync.Once
+)
+
+// CurrentRunner returns the package runner. Unless SetRunner was called,
+// it is chosen on first use from the -record and -replay flags.
+func CurrentRunner() Runner {
+	runnerOnce.Do(func() {
+		if runner == nil {
+			runner = defaultRunner()
+		}
+	})
+	return runner
+}
+
+// SetRunner replaces the package runner and returns the previous one.
+func SetRunner(r Runner) Runner {
+	prev := CurrentRunner()
+	runner = r
+	return prev
+}
+
+// ExecRunner runs commands as real processes.
+type ExecRunner struct{}
+
+// interruptGrace is how long a cancelled command has to exit after
+// SIGINT before it is killed.
+const interruptGrace = 5 * time.Second
+
+func (ExecRunner) Run(ctx context.Context, cmd Cmd) (Result, error) {
+	args, err := shell.Fields(cmd.Line, nil)
+	if err != nil {
+		return Result{ExitCode: -1}, err
+	}
+	if len(args) == 0 {
+		return Result{ExitCode: -1}, errors.New("empty command")
+	}
+	p := exec.CommandContext(ctx, args[0], args[1:]...)
+	p.Cancel = func() error { return p.Process.Signal(os.Interrupt) }
+	p.WaitDelay = interruptGrace
+	if len(cmd.Env) > 0 {
+		p.Env = append(os.Environ(), cmd.Env...)
+	}
+	if cmd.Stdin != nil {
+		p.Stdin = bytes.NewReader(cmd.Stdin)
+	}
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	p.Stdout = tee(stdout, cmd.Stdout)
+	p.Stderr = tee(stderr, cmd.Stderr)
+	err = p.Run()
+
+	r := Result{Stdout: stdout.Bytes(), Stderr: stderr.Bytes(), ExitCode: -1}
+	if p.ProcessState != nil {
+		r.ExitCode = p.ProcessState.ExitCode()
+	}
+	return r, err
+}
+
+func tee(buf *bytes.Buffer, w io.Writer) io.Writer {
+	if w == nil {
+		return buf
+	}
+	return io.MultiWriter(buf, w)
+}
+
+// Reply is a canned answer to every command line matching Match,
+// a regular expression.
+type Reply struct {
+	Match    string
+	Stdout   string
+	Stderr   string
+	ExitCode int
+	Once     bool // answer only the first matching command
+}
+
+// Fake is a scripted Runner for tests. A command is answered by the first
+// reply matching its line; unmatched commands fail with exit code 127.
+type Fake struct {
+	mu      sync.Mutex
+	replies []Reply
+	used    []bool
+	Calls   []Cmd
+}
+
+func NewFake(replies ...Reply) *Fake {
+	return &Fake{replies: replies, used: make([]bool, len(replies))}
+}
+
+func (f *Fake) Run(ctx context.Context, cmd Cmd) (Result, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.Calls = append(f.Calls, cmd)
+	if err := ctx.Err(); err != nil {
+		return Result{ExitCode: -1}, err
+	}
+	for i, reply := range f.replies {
+		if f.used[i] || !regexp.MustCompile(reply.Match).MatchString(cmd.Line) {
+			continue
+		}
+		if reply.Once {
+			f.used[i] = true
+		}
+		if cmd.Stdout != nil {
+			io.WriteString(cmd.Stdout, reply.Stdout)
+		}
+		if cmd.Stderr != nil {
+			io.WriteString(cmd.Stderr, reply.Stderr)
+		}
+		r := Result{Stdout: []byte(reply.Stdout), Stderr: []byte(reply.Stderr), ExitCode: reply.ExitCode}
+		if reply.ExitCode != 0 {
+			return r, fmt.Errorf("exit status %d", reply.ExitCode)
+		}
+		return r, nil
+	}
+	return Result{ExitCode: 127}, fmt.Errorf("fake: unexpected command: %s", cmd.Line)
+}
+
+// Lines returns the command lines the fake has been asked to run.
+func (f *Fake) Lines() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	lines := make([]string, len(f.Calls))
+	for i, cmd := range f.Calls {
+		lines[i] = cmd.Line
+	}
+	return lines
+}